@@ -4,9 +4,11 @@ package algorithm
 
 import (
 	"Bioinformatics/Sequence_alignment/utils"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math"
 	"strings"
 )
 
@@ -21,394 +23,644 @@ import (
 // j
 
 type AlignEngine struct {
-	ScoreFunc ScoreFuncType
-	ScoreGap  ScoreGapType
+	Matrix    *SubstitutionMatrix
+	GapOpen   int // Score of the first position of a gap
+	GapExtend int // Score of every following position of the same gap
 	GapChar   byte
+	Mode      AlignMode // Mode of Align, Global by default
+	EndGaps   *EndGaps  // Replaces free end gaps of the Mode if set
+
+	ctx context.Context // Set by the Context variants of the methods, see withContext
 }
+
+// Cell of the alignment matrix: position I in seq1 and J in seq2
 type Coordinate struct {
-	i, j int
+	I, J int
 }
 
+// Value used for unreachable cells of the Gotoh matrices,
+// small enough to never win and far enough from overflow
+const negInf = math.MinInt32 / 2
+
 func init() {
 	log.SetOutput(ioutil.Discard) // Comment out this line to view debug logs
 }
 
-func check(err error) {
-	if err != nil {
-		panic(err)
-	}
-}
+// Set to log the whole match table of every alignment along with the debug logs,
+// it takes O(n*m) time and memory, more than the alignment itself
+const debugTables = false
 
+// Engine with linear gap costs: every gap position scores gapPenalty
 func NewAlignEngine(scoreFunc ScoreFuncType, gapPenalty int) AlignEngine {
+	return NewAlignEngineAffine(scoreFunc, gapPenalty, gapPenalty)
+}
+
+// Engine with affine gap costs: a gap of length k scores gapOpen + (k-1)*gapExtend
+func NewAlignEngineAffine(scoreFunc ScoreFuncType, gapOpen int, gapExtend int) AlignEngine {
+	return NewMatrixAlignEngine(MatrixFromFunc("custom", scoreFunc), gapOpen, gapExtend)
+}
+
+// Engine scoring residues with the compiled substitution matrix, with affine gap costs
+func NewMatrixAlignEngine(matrix *SubstitutionMatrix, gapOpen int, gapExtend int) AlignEngine {
 	return AlignEngine{
-		ScoreFunc: scoreFunc,
-		ScoreGap:  func(_ int) int { return gapPenalty },
+		Matrix:    matrix,
+		GapOpen:   gapOpen,
+		GapExtend: gapExtend,
 		GapChar:   '-',
 	}
 }
 
+// Engine with gap costs given as a function of the position inside the gap.
+// The function is sampled at positions 0 and 1 for the affine model,
+// so only affine functions are represented exactly
 func NewAlignEngineDyn(scoreFunc ScoreFuncType, gapPenalty ScoreGapType) AlignEngine {
-	return AlignEngine{
-		ScoreFunc: scoreFunc,
-		ScoreGap:  gapPenalty,
-		GapChar:   '-',
+	return NewAlignEngineAffine(scoreFunc, gapPenalty(0), gapPenalty(1))
+}
+
+// Memory optimised Needleman-Wunsch algorithm using Hirschberg trick,
+// extended to affine gaps by Myers and Miller
+func (engine *AlignEngine) Hirschberg(seq1 string, seq2 string) (Alignment, error) {
+	seqs, err := engine.encode(seq1, seq2)
+	if err != nil {
+		return Alignment{}, err
 	}
+	res1, res2 := engine.linearRows(seqs[0], seqs[1])
+	if err := engine.contextErr(); err != nil {
+		return Alignment{}, err
+	}
+	score, err := engine.scoreRows(res1, res2)
+	if err != nil {
+		return Alignment{}, err
+	}
+	return engine.newAlignment(res1, res2, 0, 0, score)
 }
 
-// Memory optimised Needleman-Wunsch algorithm using Hirschberg trick
-func (engine *AlignEngine) Hirschberg(seq1 string, seq2 string) (string, string) {
-	// https://en.wikipedia.org/wiki/Hirschberg%27s_algorithm Some ideas
-	var resSeq1, resSeq2 strings.Builder
-	if len(seq1) == 0 {
-		for i := 0; i < len(seq2); i++ {
-			resSeq1.WriteByte(engine.GapChar)
-			resSeq2.WriteByte(seq2[i])
+// Smith-Waterman algorithm in linear memory. The best local score and its end
+// are found in one pass over the table, its start in a backward pass,
+// then the region between them is aligned with Hirschberg algorithm
+func (engine *AlignEngine) SmithWatermanLinear(seq1 string, seq2 string) (Alignment, error) {
+	seqs, err := engine.encode(seq1, seq2)
+	if err != nil {
+		return Alignment{}, err
+	}
+	score, iEnd, jEnd := engine.bestScoreLinear(seqs[0], seqs[1], true)
+	if err := engine.contextErr(); err != nil {
+		return Alignment{}, err
+	} else if score <= 0 {
+		return engine.newAlignment("", "", 0, 0, 0)
+	}
+	// The local alignment read backwards starts at its end,
+	// so its start is where the anchored backward pass reaches the same score
+	_, iLen, jLen := engine.bestScoreLinear(
+		seqs[0].slice(0, iEnd).reversed(),
+		seqs[1].slice(0, jEnd).reversed(),
+		false,
+	)
+	iStart, jStart := iEnd-iLen, jEnd-jLen
+	res1, res2 := engine.linearRows(seqs[0].slice(iStart, iEnd), seqs[1].slice(jStart, jEnd))
+	if err := engine.contextErr(); err != nil {
+		return Alignment{}, err
+	}
+	return engine.newAlignment(res1, res2, iStart, jStart, score)
+}
+
+// Best score of the Gotoh match table kept one column at a time, and its cell.
+// Local alignment may start anywhere, otherwise it starts in the top left corner.
+// The first best cell in the column by column order is returned, like in alignSequences.
+// A canceled engine stops early, its callers check contextErr
+func (engine *AlignEngine) bestScoreLinear(seq1 encodedSeq, seq2 encodedSeq, local bool) (int, int, int) {
+	height := len(seq2.enc) + 1
+	width := len(seq1.enc) + 1
+	m, x, y := make([]int, height), make([]int, height), make([]int, height)
+	prevM, prevX, prevY := make([]int, height), make([]int, height), make([]int, height)
+	for j := 0; j < height; j++ {
+		prevX[j] = negInf
+		prevY[j] = negInf
+		if !local && j > 0 {
+			prevM[j] = negInf
+			prevY[j] = engine.GapOpen + (j-1)*engine.GapExtend
 		}
-	} else if len(seq2) == 0 {
-		for i := 0; i < len(seq1); i++ {
-			resSeq1.WriteByte(seq1[i])
-			resSeq2.WriteByte(engine.GapChar)
+	}
+	best, iBest, jBest := 0, 0, 0
+	for i := 1; i < width && engine.canceled(i) == nil; i++ {
+		y[0] = negInf
+		if local {
+			m[0], x[0] = 0, negInf
+		} else {
+			m[0], x[0] = negInf, engine.GapOpen+(i-1)*engine.GapExtend
 		}
-	} else if len(seq1) == 1 || len(seq2) == 1 {
-		res1, res2, _ := engine.NeedlemanWunsch(seq1, seq2)
-		return res1, res2
-	} else {
-		mid := len(seq1) / 2
-
-		leftScore := engine.calcGridScorePart(
-			false,
-			seq1[:mid],
-			seq2,
-		)
-		rightScore := engine.calcGridScorePart(
-			true,
-			seq1[mid:],
-			seq2,
-		)
-		index := utils.SumAndMax(leftScore, rightScore)
-		log.Printf("LEFT: %s %s\n", seq1[:mid], seq2[:index])
-		leftRes1, leftRes2 := engine.Hirschberg(seq1[:mid], seq2[:index])
-		log.Printf("RIGHT: %s %s\n", seq1[mid:], seq2[index:])
-		rightRes1, rightRes2 := engine.Hirschberg(seq1[mid:], seq2[index:])
-
-		return leftRes1 + rightRes1, leftRes2 + rightRes2
-	}
-
-	return resSeq1.String(), resSeq2.String()
-}
-
-func (engine *AlignEngine) calcGridScorePart(reverse bool, seq1 string, seq2 string) []int {
-	height := len(seq2) + 1
-	width := len(seq1) + 1
-	if reverse {
-		seq1 = utils.ReverseStr(seq1)
-		seq2 = utils.ReverseStr(seq2)
-	}
-	column := make([]int, height)
-	gapInRow := 0
-	column[0] = engine.ScoreGap(gapInRow)
-	for j := 1; j < height; j++ {
-		column[j] = column[j-1] + engine.ScoreGap(gapInRow)
-		gapInRow++
+		for j := 1; j < height; j++ {
+			prev, _ := utils.Max(prevM[j-1], prevX[j-1], prevY[j-1])
+			if local && prev < 0 {
+				prev = 0
+			}
+			m[j] = prev + engine.Matrix.pair(seq1.enc[i-1], seq2.enc[j-1])
+			x[j], _ = utils.Max(prevM[j]+engine.GapOpen, prevX[j]+engine.GapExtend, prevY[j]+engine.GapOpen)
+			y[j], _ = utils.Max(m[j-1]+engine.GapOpen, x[j-1]+engine.GapOpen, y[j-1]+engine.GapExtend)
+			if m[j] > best {
+				best, iBest, jBest = m[j], i, j
+			}
+		}
+		m, prevM = prevM, m
+		x, prevX = prevX, x
+		y, prevY = prevY, y
 	}
-	log.Printf("%v\n", column)
+	return best, iBest, jBest
+}
 
-	gapInRow1, gapInRow2 := 0, 0
-	lastOverwrite := 0
-	for i := 1; i < width; i++ {
-		for j := 0; j < height; j++ {
-			if j-1 >= 0 {
-				score, err := engine.ScoreFunc(seq1[i-1], seq2[j-1])
-				check(err)
-				match := score + lastOverwrite
-				del := column[j] + engine.ScoreGap(gapInRow1)
-				insert := column[j-1] + engine.ScoreGap(gapInRow2)
-				lastOverwrite = column[j]
-				var index int
-				column[j], index = utils.Max(match, del, insert)
-				if index == 1 {
-					gapInRow1++
-					gapInRow2 = 0
-				} else if index == 2 {
-					gapInRow2++
-					gapInRow1 = 0
-				} else {
-					gapInRow1, gapInRow2 = 0, 0
+// Global alignment rows in linear memory
+func (engine *AlignEngine) linearRows(seq1 encodedSeq, seq2 encodedSeq) (string, string) {
+	var row1, row2 strings.Builder
+	free := linearEdge{state: stateAny}
+	engine.hirschberg(seq1, seq2, free, free, &row1, &row2)
+	return row1.String(), row2.String()
+}
+
+// Any state of a linearEdge
+const stateAny = -1
+
+// Start or end of a sub-problem of the linear memory alignment: the state
+// of its first or last column, and for the start whether a gap in that state
+// continues the gap ending the previous sub-problem, so it is not opened again
+type linearEdge struct {
+	state     int
+	continued bool
+}
+
+// Score of the first column of a gap of the given state at the edge,
+// negInf when the edge does not allow it
+func (engine *AlignEngine) edgeGap(edge linearEdge, state int) int {
+	switch {
+	case edge.state == state && edge.continued:
+		return engine.GapExtend
+	case edge.state == state, edge.state == stateAny:
+		return engine.GapOpen
+	}
+	return negInf
+}
+
+// Myers-Miller version of Hirschberg algorithm for affine gaps.
+// seq1 is split in the middle, the forward pass over the left half and
+// the backward pass over the right half give every cell of the middle column
+// the best scores of the halves by the state the left one ends in and the right
+// one starts in. Halves ending and starting with the same gap are one gap opened once.
+// The states of the best crossing are the edges of the halves, so the rows
+// score exactly what the split does whatever the gap costs are
+func (engine *AlignEngine) hirschberg(seq1 encodedSeq, seq2 encodedSeq, start linearEdge, end linearEdge,
+	row1 *strings.Builder, row2 *strings.Builder) {
+	// https://en.wikipedia.org/wiki/Hirschberg%27s_algorithm Some ideas
+	// E. W. Myers, W. Miller. Optimal alignments in linear space, 1988
+	width, height := len(seq1.enc), len(seq2.enc)
+	if engine.contextErr() != nil {
+		// The rows of a canceled alignment are dropped by the caller
+		return
+	} else if height == 0 {
+		engine.writeGap(row1, row2, seq1.raw, true)
+		return
+	} else if width == 0 {
+		engine.writeGap(row1, row2, seq2.raw, false)
+		return
+	} else if width == 1 {
+		engine.gotohRows(seq1, seq2, start, end, row1, row2)
+		return
+	}
+	mid := width / 2
+	left := engine.linearColumn(seq1.slice(0, mid), seq2, start)
+	// Read backwards the right half starts at its end, its last column is the middle one
+	right := engine.linearColumn(seq1.slice(mid, width).reversed(), seq2.reversed(), linearEdge{state: end.state})
+	open := engine.GapOpen - engine.GapExtend
+	best, index, leftState, rightState := negInf, 0, stateM, stateM
+	for j := 0; j <= height; j++ {
+		for stateL, scoreL := range left.cell(j) {
+			for stateR, scoreR := range right.cell(height - j) {
+				score := scoreL + scoreR
+				if stateL == stateR && stateL != stateM {
+					score -= open
 				}
-			} else {
-				// Not sure if this block is correct {
-				lastOverwrite = column[j]
-				if i > 0 {
-					column[j] = engine.ScoreGap(i)
-				} else {
-					column[j] = 0
+				if score > best {
+					best, index, leftState, rightState = score, j, stateL, stateR
 				}
-				// }
 			}
 		}
-		log.Printf("%d: %v\n", i, column)
 	}
-	if reverse {
-		utils.ReverseArray(column)
+	log.Printf("SPLIT: %s %s %d %d %d\n", seq1.raw, seq2.raw, index, leftState, rightState)
+	joined := leftState == rightState && leftState != stateM
+	engine.hirschberg(seq1.slice(0, mid), seq2.slice(0, index), start, linearEdge{state: leftState}, row1, row2)
+	engine.hirschberg(seq1.slice(mid, width), seq2.slice(index, height), linearEdge{rightState, joined}, end, row1, row2)
+}
+
+// Writes the residues against gaps, into the first row if first is set
+func (engine *AlignEngine) writeGap(row1 *strings.Builder, row2 *strings.Builder, residues string, first bool) {
+	for k := 0; k < len(residues); k++ {
+		if first {
+			row1.WriteByte(residues[k])
+			row2.WriteByte(engine.GapChar)
+		} else {
+			row1.WriteByte(engine.GapChar)
+			row2.WriteByte(residues[k])
+		}
+	}
+}
+
+// Column of the three Gotoh matrices, indexed by the position in seq2
+type gotohColumn struct {
+	m, x, y []int
+}
+
+// Scores of the cell indexed by the states
+func (column gotohColumn) cell(j int) [3]int {
+	return [3]int{stateM: column.m[j], stateX: column.x[j], stateY: column.y[j]}
+}
+
+// First column of the Gotoh matrices, the alignments start in the top left corner at the edge
+func (engine *AlignEngine) firstColumn(height int, start linearEdge) gotohColumn {
+	column := gotohColumn{make([]int, height+1), make([]int, height+1), make([]int, height+1)}
+	column.m[0], column.x[0], column.y[0] = negInf, negInf, negInf
+	if start.state == stateAny || start.state == stateM {
+		column.m[0] = 0
+	}
+	for j := 1; j <= height; j++ {
+		column.m[j], column.x[j] = negInf, negInf
+		column.y[j] = engine.edgeGap(start, stateY) + (j-1)*engine.GapExtend
 	}
 	return column
 }
 
-func (engine *AlignEngine) NeedlemanWunsch(seq1 string, seq2 string) (string, string, int) {
-	if len(seq1) > len(seq2) {
-		res2, res1, score := engine.AlignSequences(seq2, seq1, false)
-		return res1, res2, score
+// Fills column i of the Gotoh matrices from the previous one, residue is seq1[i-1]
+func (engine *AlignEngine) nextColumn(prev gotohColumn, column gotohColumn, i int, residue byte, seq2 encodedSeq,
+	start linearEdge) {
+	open, ext := engine.GapOpen, engine.GapExtend
+	column.m[0], column.y[0] = negInf, negInf
+	column.x[0] = engine.edgeGap(start, stateX) + (i-1)*ext
+	for j := 1; j < len(column.m); j++ {
+		diagonal, _ := utils.Max(prev.m[j-1], prev.x[j-1], prev.y[j-1])
+		column.m[j] = diagonal + engine.Matrix.pair(residue, seq2.enc[j-1])
+		column.x[j], _ = utils.Max(prev.m[j]+open, prev.x[j]+ext, prev.y[j]+open)
+		column.y[j], _ = utils.Max(column.m[j-1]+open, column.x[j-1]+open, column.y[j-1]+ext)
 	}
-	return engine.AlignSequences(seq1, seq2, false)
 }
 
-func (engine *AlignEngine) SmithWaterman(seq1 string, seq2 string) (string, string, int) {
-	if len(seq1) > len(seq2) {
-		res2, res1, score := engine.AlignSequences(seq2, seq1, true)
-		return res1, res2, score
+// Last column of the Gotoh matrices of seq1 against seq2 in linear memory,
+// the alignments start in the top left corner at the edge
+func (engine *AlignEngine) linearColumn(seq1 encodedSeq, seq2 encodedSeq, start linearEdge) gotohColumn {
+	height := len(seq2.enc)
+	column := engine.firstColumn(height, start)
+	prev := gotohColumn{make([]int, height+1), make([]int, height+1), make([]int, height+1)}
+	for i := 1; i <= len(seq1.enc) && engine.canceled(i) == nil; i++ {
+		prev, column = column, prev
+		engine.nextColumn(prev, column, i, seq1.enc[i-1], seq2, start)
 	}
-	return engine.AlignSequences(seq1, seq2, true)
+	log.Printf("%v\n", column.cell(height))
+	return column
 }
 
-func (engine *AlignEngine) AlignSequences(seq1 string, seq2 string, local bool) (string, string, int) {
-	table := make([][]int, len(seq2)+1)
-	for i := range table {
-		table[i] = make([]int, len(seq1)+1)
+// Rows of the whole Gotoh matrices traced back from the end, for a single residue of seq1
+func (engine *AlignEngine) gotohRows(seq1 encodedSeq, seq2 encodedSeq, start linearEdge, end linearEdge,
+	row1 *strings.Builder, row2 *strings.Builder) {
+	width, height := len(seq1.enc), len(seq2.enc)
+	columns := []gotohColumn{engine.firstColumn(height, start)}
+	for i := 1; i <= width; i++ {
+		column := gotohColumn{make([]int, height+1), make([]int, height+1), make([]int, height+1)}
+		engine.nextColumn(columns[i-1], column, i, seq1.enc[i-1], seq2, start)
+		columns = append(columns, column)
+	}
+	state := end.state
+	if state == stateAny {
+		cell := columns[width].cell(height)
+		_, state = utils.Max(cell[:]...)
+	}
+	// The rows are collected from the end
+	var res1, res2 strings.Builder
+	open, ext := engine.GapOpen, engine.GapExtend
+	for i, j := width, height; i > 0 || j > 0; {
+		column := columns[i]
+		switch {
+		case state == stateM:
+			res1.WriteByte(seq1.raw[i-1])
+			res2.WriteByte(seq2.raw[j-1])
+			score := column.m[j] - engine.Matrix.pair(seq1.enc[i-1], seq2.enc[j-1])
+			i, j = i-1, j-1
+			prev := columns[i].cell(j)
+			state = previousOf(score, prev[stateM], prev[stateX], prev[stateY])
+		case state == stateX:
+			res1.WriteByte(seq1.raw[i-1])
+			res2.WriteByte(engine.GapChar)
+			score := column.x[j]
+			i--
+			if j > 0 {
+				prev := columns[i].cell(j)
+				state = previousOf(score, prev[stateM]+open, prev[stateX]+ext, prev[stateY]+open)
+			}
+		default:
+			res1.WriteByte(engine.GapChar)
+			res2.WriteByte(seq2.raw[j-1])
+			score := column.y[j]
+			j--
+			if i > 0 {
+				prev := column.cell(j)
+				state = previousOf(score, prev[stateM]+open, prev[stateX]+open, prev[stateY]+ext)
+			}
+		}
 	}
+	row1.WriteString(reverseBytes(res1.String()))
+	row2.WriteString(reverseBytes(res2.String()))
+}
+
+// State whose score leads to the given one, a match preferred
+func previousOf(score int, fromM int, fromX int, fromY int) int {
+	switch score {
+	case fromM:
+		return stateM
+	case fromX:
+		return stateX
+	}
+	return stateY
+}
+
+func (engine *AlignEngine) NeedlemanWunsch(seq1 string, seq2 string) (Alignment, error) {
+	return engine.alignShorterFirst(seq1, seq2, false)
+}
+
+func (engine *AlignEngine) SmithWaterman(seq1 string, seq2 string) (Alignment, error) {
+	return engine.alignShorterFirst(seq1, seq2, true)
+}
+
+func (engine *AlignEngine) alignShorterFirst(seq1 string, seq2 string, local bool) (Alignment, error) {
+	seqs, err := engine.encode(seq1, seq2)
+	if err != nil {
+		return Alignment{}, err
+	}
+	return engine.alignEncoded(seqs[0], seqs[1], local, EndGaps{})
+}
+
+// Aligns the encoded sequences, the shorter one goes along the table rows
+func (engine *AlignEngine) alignEncoded(seq1 encodedSeq, seq2 encodedSeq, local bool, ends EndGaps) (Alignment, error) {
+	if len(seq1.enc) > len(seq2.enc) {
+		alignment, err := engine.alignSequences(seq2, seq1, local, ends.swapped())
+		return alignment.swapped(), err
+	}
+	return engine.alignSequences(seq1, seq2, local, ends)
+}
+
+// Gotoh matrices, indexed as [j][i] like the matrix structure above.
+// m - alignments of the prefixes ending with seq1[i-1] against seq2[j-1],
+// x - ending with seq1[i-1] against a gap, y - ending with a gap against seq2[j-1]
+type gotohTables struct {
+	m, x, y [][]int
+}
+
+// Cells of the Gotoh matrices as read by the traceback,
+// implemented by the full tables and by the banded ones
+type gotohCells interface {
+	cell(j int, i int) (m int, x int, y int)
+}
+
+func (t gotohTables) cell(j int, i int) (int, int, int) {
+	return t.m[j][i], t.x[j][i], t.y[j][i]
+}
+
+// States of the traceback, one per Gotoh matrix
+const (
+	stateM = iota
+	stateX
+	stateY
+)
+
+func newGotohTables(height int, width int) gotohTables {
+	newTable := func() [][]int {
+		table := make([][]int, height)
+		for j := range table {
+			table[j] = make([]int, width)
+		}
+		return table
+	}
+	return gotohTables{
+		m: newTable(),
+		x: newTable(),
+		y: newTable(),
+	}
+}
+
+// Global (Needleman-Wunsch) or local (Smith-Waterman) alignment
+// with affine gaps, using Gotoh three matrices algorithm
+func (engine *AlignEngine) AlignSequences(seq1 string, seq2 string, local bool) (Alignment, error) {
+	seqs, err := engine.encode(seq1, seq2)
+	if err != nil {
+		return Alignment{}, err
+	}
+	return engine.alignSequences(seqs[0], seqs[1], local, EndGaps{})
+}
+
+// Gotoh alignment, ends are the end gaps that cost nothing in global alignment
+func (engine *AlignEngine) alignSequences(seq1 encodedSeq, seq2 encodedSeq,
+	local bool, ends EndGaps) (Alignment, error) {
+	height := len(seq2.enc) + 1
+	width := len(seq1.enc) + 1
+	t := newGotohTables(height, width)
 	// We track max element of the matrix for local alignment
 	iMax := 0
 	jMax := 0
 
-	// Init first row and column
-	gapInRow := 0
-	table[0][0] = 0
-	for i := 1; i < len(table[0]); i++ {
+	// Init first row and column. Local alignment may start anywhere,
+	// so it never pays for the leading gaps
+	t.x[0][0], t.y[0][0] = negInf, negInf
+	for i := 1; i < width; i++ {
+		t.y[0][i] = negInf
 		if local {
-			table[0][i] = 0
+			t.x[0][i] = negInf
+		} else if ends.Leading1 {
+			t.m[0][i] = negInf
+			t.x[0][i] = 0
 		} else {
-			table[0][i] = table[0][i-1] + engine.ScoreGap(gapInRow)
-			gapInRow++
+			t.m[0][i] = negInf
+			t.x[0][i] = engine.GapOpen + (i-1)*engine.GapExtend
 		}
 	}
-	gapInRow = 0
-	table[0][0] = 0
-	for j := 1; j < len(table); j++ {
+	for j := 1; j < height; j++ {
+		t.x[j][0] = negInf
 		if local {
-			table[j][0] = 0
+			t.y[j][0] = negInf
+		} else if ends.Leading2 {
+			t.m[j][0] = negInf
+			t.y[j][0] = 0
 		} else {
-			table[j][0] = table[j-1][0] + engine.ScoreGap(gapInRow)
-			gapInRow++
+			t.m[j][0] = negInf
+			t.y[j][0] = engine.GapOpen + (j-1)*engine.GapExtend
 		}
 	}
 
-	// Fill the table
-	gapInRow1, gapInRow2 := 0, 0
-	for i := 1; i < len(table[0]); i++ {
-		for j := 1; j < len(table); j++ {
-			score, err := engine.ScoreFunc(seq1[i-1], seq2[j-1])
-			check(err)
-			match := table[j-1][i-1] + score
-			del := table[j][i-1] + engine.ScoreGap(gapInRow1)
-			insert := table[j-1][i] + engine.ScoreGap(gapInRow2)
-			if local {
-				val, index := utils.Max(match, del, insert, 0)
-				if index == 1 {
-					gapInRow1++
-					gapInRow2 = 0
-				} else if index == 2 {
-					gapInRow2++
-					gapInRow1 = 0
-				} else {
-					gapInRow1, gapInRow2 = 0, 0
-				}
-				if val > table[jMax][iMax] {
-					jMax = j
-					iMax = i
-				}
-				table[j][i] = val
-			} else {
-				var index int
-				table[j][i], index = utils.Max(match, del, insert)
-				if index == 1 {
-					gapInRow1++
-					gapInRow2 = 0
-				} else if index == 2 {
-					gapInRow2++
-					gapInRow1 = 0
-				} else {
-					gapInRow1, gapInRow2 = 0, 0
-				}
+	// Fill the tables
+	for i := 1; i < width; i++ {
+		if err := engine.canceled(i); err != nil {
+			return Alignment{}, err
+		}
+		for j := 1; j < height; j++ {
+			score := engine.Matrix.pair(seq1.enc[i-1], seq2.enc[j-1])
+			prev, _ := utils.Max(t.m[j-1][i-1], t.x[j-1][i-1], t.y[j-1][i-1])
+			if local && prev < 0 {
+				prev = 0
+			}
+			t.m[j][i] = prev + score
+			t.x[j][i], _ = utils.Max(
+				t.m[j][i-1]+engine.GapOpen,
+				t.x[j][i-1]+engine.GapExtend,
+				t.y[j][i-1]+engine.GapOpen,
+			)
+			t.y[j][i], _ = utils.Max(
+				t.m[j-1][i]+engine.GapOpen,
+				t.x[j-1][i]+engine.GapOpen,
+				t.y[j-1][i]+engine.GapExtend,
+			)
+			if local && t.m[j][i] > t.m[jMax][iMax] {
+				jMax = j
+				iMax = i
 			}
 		}
 	}
-	printMatrix(table)
+	if debugTables {
+		printMatrix(t.m)
+	}
 
-	return engine.findAlign(seq1, seq2, table, local, iMax, jMax)
+	if !local {
+		iMax, jMax = bestEnd(t, ends, width, height)
+	}
+	return engine.findAlign(seq1, seq2, t, local, ends, iMax, jMax)
 }
 
-// Find align for both sequences with the given weight table
-func (engine *AlignEngine) findAlign(seq1 string, seq2 string,
-	table [][]int, local bool, iMax, jMax int) (string, string, int) {
-	var i, j int
+// Cell where the global alignment ends: the bottom right one,
+// or any cell of the last row or column when the trailing gaps are free
+func bestEnd(t gotohCells, ends EndGaps, width int, height int) (int, int) {
+	iBest, jBest := width-1, height-1
+	best, _ := utils.Max(t.cell(jBest, iBest))
+	if ends.Trailing1 {
+		for i := 0; i < width-1; i++ {
+			if score, _ := utils.Max(t.cell(jBest, i)); score > best {
+				best, iBest = score, i
+			}
+		}
+	}
+	if ends.Trailing2 {
+		iLast := width - 1
+		for j := 0; j < height-1; j++ {
+			if score, _ := utils.Max(t.cell(j, iLast)); score > best {
+				best, iBest, jBest = score, iLast, j
+			}
+		}
+	}
+	return iBest, jBest
+}
+
+// Find align for both sequences with the given Gotoh tables,
+// starting from the cell (iEnd, jEnd) where the alignment ends
+func (engine *AlignEngine) findAlign(seq1 encodedSeq, seq2 encodedSeq,
+	t gotohCells, local bool, ends EndGaps, iEnd, jEnd int) (Alignment, error) {
+	i, j := iEnd, jEnd
+	var state, resScore int
 	if local {
-		i = iMax
-		j = jMax
+		state = stateM
+		resScore, _, _ = t.cell(j, i)
 	} else {
-		i = len(table[0]) - 1
-		j = len(table) - 1
+		resScore, state = utils.Max(t.cell(j, i))
 	}
 	var sbSeq1, sbSeq2 strings.Builder
 
-	gapInRow1, gapInRow2 := 0, 0
+traceback:
 	for i > 0 || j > 0 {
-		if i > 0 && j > 0 {
-			score, err := engine.ScoreFunc(seq1[i-1], seq2[j-1])
-			check(err)
-			if table[j][i] == table[j-1][i-1]+score {
-				sbSeq1.WriteByte(seq1[i-1])
-				sbSeq2.WriteByte(seq2[j-1])
-				i--
-				j--
-				gapInRow1, gapInRow2 = 0, 0
-				if local && table[j][i] == 0 {
-					break
-				}
-				continue
+		// Leading gaps go straight along the border
+		if !local && j == 0 {
+			for ; i > 0 && !ends.Leading1; i-- {
+				sbSeq1.WriteByte(seq1.raw[i-1])
+				sbSeq2.WriteByte(engine.GapChar)
 			}
+			break
 		}
-
-		if i > 0 && (table[j][i] == table[j][i-1]+engine.ScoreGap(gapInRow2) || j == 0) {
-			sbSeq1.WriteByte(seq1[i-1])
+		if !local && i == 0 {
+			for ; j > 0 && !ends.Leading2; j-- {
+				sbSeq1.WriteByte(engine.GapChar)
+				sbSeq2.WriteByte(seq2.raw[j-1])
+			}
+			break
+		}
+		switch state {
+		case stateM:
+			score := engine.Matrix.pair(seq1.enc[i-1], seq2.enc[j-1])
+			cur, _, _ := t.cell(j, i)
+			prev := cur - score
+			sbSeq1.WriteByte(seq1.raw[i-1])
+			sbSeq2.WriteByte(seq2.raw[j-1])
+			i--
+			j--
+			if local && prev == 0 {
+				// Local alignment starts here
+				break traceback
+			}
+			m, x, _ := t.cell(j, i)
+			if prev == m {
+				state = stateM
+			} else if prev == x {
+				state = stateX
+			} else {
+				state = stateY
+			}
+		case stateX:
+			_, cur, _ := t.cell(j, i)
+			sbSeq1.WriteByte(seq1.raw[i-1])
 			sbSeq2.WriteByte(engine.GapChar)
-			gapInRow2++
-			gapInRow1 = 0
 			i--
-			if table[j][i] == 0 {
-				break
+			m, x, _ := t.cell(j, i)
+			if cur == m+engine.GapOpen {
+				state = stateM
+			} else if cur == x+engine.GapExtend {
+				state = stateX
+			} else {
+				state = stateY
 			}
-		} else {
-			gapInRow1++
-			gapInRow2 = 0
+		case stateY:
+			_, _, cur := t.cell(j, i)
 			sbSeq1.WriteByte(engine.GapChar)
-			sbSeq2.WriteByte(seq2[j-1])
+			sbSeq2.WriteByte(seq2.raw[j-1])
 			j--
-			if table[j][i] == 0 {
-				break
+			m, x, _ := t.cell(j, i)
+			if cur == m+engine.GapOpen {
+				state = stateM
+			} else if cur == x+engine.GapOpen {
+				state = stateX
+			} else {
+				state = stateY
 			}
 		}
 	}
-	resScore := table[len(table)-1][len(table[0])-1]
-	return utils.ReverseStr(sbSeq1.String()), utils.ReverseStr(sbSeq2.String()), resScore
+	return engine.newAlignment(
+		utils.ReverseStr(sbSeq1.String()),
+		utils.ReverseStr(sbSeq2.String()),
+		i, j, resScore,
+	)
 }
 
-func (engine *AlignEngine) MultiAlignSequences(template string, seqs []string) (string, string, int, int) {
-	if len(seqs) == 0 {
-		panic("Sequences are empty!")
-	} else if len(template) == 0 {
-		panic("Template length is 0!")
-	}
-	const TUBE_RADIUS = 3
-	//bestIndex := 0
-	bestScore := 0
-	bestIndex := 0
-	var bestStr1, bestStr2 string
+// Finds the sequence most similar to the template with the FASTA heuristic
+// and default parameters. Returns the local alignment of the template (Row1)
+// against the best sequence (Row2) and the index of the latter.
+// Errors of particular sequences are reported as *RecordError
+func (engine *AlignEngine) MultiAlignSequences(template string, seqs []string) (Alignment, int, error) {
+	records := make([]Sequence, len(seqs))
 	for i, seq := range seqs {
-		if len(seq) == 0 {
-			panic("Seq length is 0!")
-		}
-		matrix := BuildMatrix(seq, template)
-		sum, vi, firstNonNull, lastNonNull := CalcDiagScore(matrix)
-		log.Printf("vi: %d\n sum: %d\n", vi, sum)
-		log.Printf("First (%d, %d)\n", firstNonNull.i, firstNonNull.j)
-		log.Printf("Last (%d, %d)\n", lastNonNull.i, lastNonNull.j)
-		str1, str2, score := engine.SmithWaterman(
-			template[firstNonNull.i:lastNonNull.i+2],
-			seq[firstNonNull.j:lastNonNull.j+2],
-		)
-		if score > bestScore {
-			bestScore = score
-			bestStr1 = str1
-			bestStr2 = str2
-			bestIndex = i
-		}
-		log.Printf("Score: %d\n", score)
-		log.Printf("RESULT:\n%s\n%s\n%d\n", str1, str2, score)
+		records[i].Residues = seq
 	}
-	return bestStr1, bestStr2, bestScore, bestIndex
-}
-
-func makeMap(templ string, l int) map[string][]int {
-	mapa := make(map[string][]int)
-
-	for i := 0; i < len(templ)-l+1; i++ {
-		id := templ[i : i+l]
-		if val, ok := mapa[id]; ok {
-			mapa[id] = append(val, i)
-		} else {
-			mapa[id] = []int{i}
-		}
-	}
-
-	return mapa
-}
-
-func BuildMatrix(s_i string, templ string) [][]byte {
-	l := 2
-	mapa := makeMap(s_i, 2)
-	matrix := make([][]byte, len(s_i)-1)
-	for i := range matrix {
-		matrix[i] = make([]byte, len(templ)-1)
-	}
-	for i := 0; i < len(templ)-l+1; i++ {
-		id := templ[i : i+l]
-		if val, ok := mapa[id]; ok {
-			for _, j := range val {
-				matrix[j][i] = 1
-			}
-		}
+	hits, err := engine.FastaSearch(template, records, DefaultFastaParams())
+	if err != nil {
+		return Alignment{}, 0, err
 	}
-	return matrix
-}
-
-func CalcDiagScore(matrix [][]byte) (int, int, Coordinate, Coordinate) {
-	height := len(matrix)
-	width := len(matrix[0])
-	maxSum := 0
-	resVi := 0
-	firstNonNull := make(map[int]Coordinate)
-	lastNonNull := make(map[int]Coordinate)
-	for vi := 0; vi < height+width-1; vi++ {
-		j, _ := utils.Max(height-1-vi, 0)
-		i := 0
-		if vi >= height-1 {
-			i = vi - (height - 1)
-		}
-		sum := 0
-		for i < width && j < height {
-			val := int(matrix[j][i])
-			if _, ok := firstNonNull[vi]; !ok && val == 1 {
-				firstNonNull[vi] = Coordinate{
-					i: i,
-					j: j,
-				}
-			}
-			if val == 1 {
-				lastNonNull[vi] = Coordinate{
-					i: i,
-					j: j,
-				}
-			}
-			sum += val
-			i++
-			j++
+	best := 0
+	for i, hit := range hits {
+		if hit.Err != nil {
+			return Alignment{}, 0, hit.Err
 		}
-		//fmt.Printf("vi: %d\nsum: %d\n\n", vi, sum)
-		if maxSum < sum {
-			maxSum = sum
-			resVi = vi
+		log.Printf("%d: initn %d init1 %d opt %d\n", i, hit.Initn, hit.Init1, hit.Opt)
+		if hit.Opt > hits[best].Opt {
+			best = i
 		}
 	}
-	return maxSum, resVi, firstNonNull[resVi], lastNonNull[resVi]
+	return hits[best].Alignment, best, nil
 }
 
 // Only for debug purposes
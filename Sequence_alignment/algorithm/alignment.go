@@ -0,0 +1,110 @@
+package algorithm
+
+import "strings"
+
+// Result of a pairwise alignment.
+// Coordinates are 0-based, Start is inclusive and End is exclusive,
+// so seq1[Start1:End1] is exactly the part of seq1 present in Row1
+type Alignment struct {
+	Row1, Row2   string // Aligned sequences, gaps are written with GapChar
+	Score        int
+	Start1, End1 int
+	Start2, End2 int
+	Identities   int    // Columns with equal residues
+	Similarities int    // Columns with positive substitution score, identities included
+	Gaps         int    // Columns with a gap in either row
+	Cigar        string // Extended CIGAR of Row2 against Row1 taken as reference
+}
+
+// Number of alignment columns
+func (alignment *Alignment) Length() int {
+	return len(alignment.Row1)
+}
+
+// Builds the alignment of seq1[start1:] and seq2[start2:] from the aligned rows
+func (engine *AlignEngine) newAlignment(row1 string, row2 string, start1 int, start2 int, score int) (Alignment, error) {
+	alignment := Alignment{
+		Row1:   row1,
+		Row2:   row2,
+		Score:  score,
+		Start1: start1,
+		End1:   start1,
+		Start2: start2,
+		End2:   start2,
+	}
+	for k := 0; k < len(row1); k++ {
+		a, b := row1[k], row2[k]
+		if a != engine.GapChar {
+			alignment.End1++
+		}
+		if b != engine.GapChar {
+			alignment.End2++
+		}
+		if a == engine.GapChar || b == engine.GapChar {
+			alignment.Gaps++
+			continue
+		}
+		if a == b {
+			alignment.Identities++
+		}
+		pairScore, err := engine.Matrix.Score(a, b)
+		if err != nil {
+			return Alignment{}, err
+		}
+		if pairScore > 0 {
+			alignment.Similarities++
+		}
+	}
+	alignment.Cigar = engine.RowsCigar(row1, row2).String()
+	return alignment, nil
+}
+
+// Score of the given aligned rows under the engine scoring scheme
+func (engine *AlignEngine) scoreRows(row1 string, row2 string) (int, error) {
+	score := 0
+	var prevGap1, prevGap2 bool
+	for k := 0; k < len(row1); k++ {
+		gap1, gap2 := row1[k] == engine.GapChar, row2[k] == engine.GapChar
+		switch {
+		case gap1 && prevGap1, gap2 && prevGap2:
+			score += engine.GapExtend
+		case gap1, gap2:
+			score += engine.GapOpen
+		default:
+			pairScore, err := engine.Matrix.Score(row1[k], row2[k])
+			if err != nil {
+				return 0, err
+			}
+			score += pairScore
+		}
+		prevGap1, prevGap2 = gap1, gap2
+	}
+	return score, nil
+}
+
+// The same alignment with the sequences swapped
+func (alignment Alignment) swapped() Alignment {
+	alignment.Row1, alignment.Row2 = alignment.Row2, alignment.Row1
+	alignment.Start1, alignment.Start2 = alignment.Start2, alignment.Start1
+	alignment.End1, alignment.End2 = alignment.End2, alignment.End1
+	alignment.Cigar = strings.Map(func(op rune) rune {
+		switch op {
+		case 'I':
+			return 'D'
+		case 'D':
+			return 'I'
+		}
+		return op
+	}, alignment.Cigar)
+	return alignment
+}
+
+// The same alignment with the coordinates moved by the given offsets,
+// used when the aligned sequences are slices of longer ones
+func (alignment Alignment) shifted(offset1 int, offset2 int) Alignment {
+	alignment.Start1 += offset1
+	alignment.End1 += offset1
+	alignment.Start2 += offset2
+	alignment.End2 += offset2
+	return alignment
+}
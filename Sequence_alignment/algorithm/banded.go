@@ -0,0 +1,154 @@
+package algorithm
+
+import "Bioinformatics/Sequence_alignment/utils"
+
+// Diagonals added on both sides of the band beyond the length difference
+// when the bandwidth is derived automatically
+const DefaultBandMargin = 16
+
+// Bandwidth that lets the global alignment of sequences of the given lengths
+// reach its end cell and still move margin diagonals away from it
+func AutoBandwidth(len1 int, len2 int, margin int) int {
+	diff := len1 - len2
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff + margin
+}
+
+// Gotoh matrices restricted to the diagonal band |i - j - offset| <= w,
+// every row keeps 2w+1 cells. Cells outside the band are unreachable
+type bandTables struct {
+	m, x, y []int
+	w       int
+	offset  int // Diagonal i - j in the middle of the band
+}
+
+func newBandTables(height int, w int, offset int) bandTables {
+	size := height * (2*w + 1)
+	return bandTables{
+		m:      make([]int, size),
+		x:      make([]int, size),
+		y:      make([]int, size),
+		w:      w,
+		offset: offset,
+	}
+}
+
+func (t bandTables) index(j int, i int) int {
+	return j*(2*t.w+1) + i - j - t.offset + t.w
+}
+
+func (t bandTables) cell(j int, i int) (int, int, int) {
+	if d := i - j - t.offset; d > t.w || -d > t.w {
+		return negInf, negInf, negInf
+	}
+	k := t.index(j, i)
+	return t.m[k], t.x[k], t.y[k]
+}
+
+// Global or semi-global alignment in the engine Mode computed only for the cells
+// within bandwidth diagonals of the main one, in O((len1+len2)*bandwidth) time and memory.
+// Bandwidth 0 or less is derived with AutoBandwidth and DefaultBandMargin.
+// The returned flag is set when the alignment path touches the band edge:
+// a better alignment may leave the band, so the caller may retry with a wider one
+func (engine *AlignEngine) AlignBanded(seq1 string, seq2 string, bandwidth int) (Alignment, bool, error) {
+	if engine.Mode == Local {
+		return Alignment{}, false, ErrBandedLocal
+	}
+	seqs, err := engine.encode(seq1, seq2)
+	if err != nil {
+		return Alignment{}, false, err
+	}
+	if bandwidth <= 0 {
+		bandwidth = AutoBandwidth(len(seq1), len(seq2), DefaultBandMargin)
+	}
+	ends := engine.freeEnds()
+	width := len(seq1) + 1
+	height := len(seq2) + 1
+	t, _, _, _ := engine.fillBand(seqs[0], seqs[1], false, ends, bandwidth, 0)
+	if err := engine.contextErr(); err != nil {
+		return Alignment{}, false, err
+	}
+
+	iEnd, jEnd := bestEnd(t, ends, width, height)
+	if score, _ := utils.Max(t.cell(jEnd, iEnd)); score <= negInf/2 {
+		return Alignment{}, false, ErrBandTooNarrow
+	}
+	alignment, err := engine.findAlign(seqs[0], seqs[1], t, false, ends, iEnd, jEnd)
+	if err != nil {
+		return Alignment{}, false, err
+	}
+	return alignment, engine.touchesBand(alignment, bandwidth), nil
+}
+
+// The same recurrences as alignSequences for the cells of the band around
+// the diagonal offset. Local alignment also returns its best score and cell.
+// A canceled engine stops early, its callers check contextErr
+func (engine *AlignEngine) fillBand(seq1 encodedSeq, seq2 encodedSeq,
+	local bool, ends EndGaps, w int, offset int) (bandTables, int, int, int) {
+	t := newBandTables(len(seq2.enc)+1, w, offset)
+	best, iBest, jBest := 0, 0, 0
+	for j := 0; j <= len(seq2.enc) && engine.canceled(j) == nil; j++ {
+		iFrom, _ := utils.Max(0, j+offset-w)
+		iTo, _ := utils.Min(len(seq1.enc), j+offset+w)
+		for i := iFrom; i <= iTo; i++ {
+			k := t.index(j, i)
+			switch {
+			case local && (i == 0 || j == 0):
+				t.m[k], t.x[k], t.y[k] = 0, negInf, negInf
+			case i == 0 && j == 0:
+				t.m[k], t.x[k], t.y[k] = 0, negInf, negInf
+			case j == 0:
+				t.m[k], t.y[k] = negInf, negInf
+				t.x[k] = engine.GapOpen + (i-1)*engine.GapExtend
+				if ends.Leading1 {
+					t.x[k] = 0
+				}
+			case i == 0:
+				t.m[k], t.x[k] = negInf, negInf
+				t.y[k] = engine.GapOpen + (j-1)*engine.GapExtend
+				if ends.Leading2 {
+					t.y[k] = 0
+				}
+			default:
+				prev, _ := utils.Max(t.cell(j-1, i-1))
+				if local && prev < 0 {
+					prev = 0
+				}
+				t.m[k] = prev + engine.Matrix.pair(seq1.enc[i-1], seq2.enc[j-1])
+				m, x, y := t.cell(j, i-1)
+				t.x[k], _ = utils.Max(m+engine.GapOpen, x+engine.GapExtend, y+engine.GapOpen)
+				m, x, y = t.cell(j-1, i)
+				t.y[k], _ = utils.Max(m+engine.GapOpen, x+engine.GapOpen, y+engine.GapExtend)
+				if local && t.m[k] > best {
+					best, iBest, jBest = t.m[k], i, j
+				}
+			}
+		}
+	}
+	return t, best, iBest, jBest
+}
+
+// Whether any cell of the alignment path lies on the band edge
+func (engine *AlignEngine) touchesBand(alignment Alignment, w int) bool {
+	i, j := alignment.Start1, alignment.Start2
+	onEdge := func() bool {
+		return i-j == w || j-i == w
+	}
+	if onEdge() {
+		return true
+	}
+	for k := 0; k < len(alignment.Row1); k++ {
+		if alignment.Row1[k] != engine.GapChar {
+			i++
+		}
+		if alignment.Row2[k] != engine.GapChar {
+			j++
+		}
+		if onEdge() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package algorithm
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Operations of the extended CIGAR of the SAM specification
+const cigarOps = "MIDNSHP=X"
+
+// Run of one CIGAR operation
+type CigarOp struct {
+	Length int
+	Op     byte
+}
+
+// CIGAR of seq2 against seq1 taken as reference: 'M' aligned residues, '=' identity,
+// 'X' mismatch, 'I' residue of seq2 against a gap, 'D' residue of seq1 against a gap,
+// 'N' skipped residues of seq1, 'S' and 'H' soft and hard clipped residues of seq2,
+// 'P' padding that consumes neither sequence
+type Cigar []CigarOp
+
+func (cigar Cigar) String() string {
+	var sb strings.Builder
+	for _, op := range cigar {
+		sb.WriteString(strconv.Itoa(op.Length))
+		sb.WriteByte(op.Op)
+	}
+	return sb.String()
+}
+
+// Residues of seq1 and seq2 covered by the CIGAR, clips included
+func (cigar Cigar) Lengths() (int, int) {
+	length1, length2 := 0, 0
+	for _, op := range cigar {
+		if consumes1(op.Op) {
+			length1 += op.Length
+		}
+		if consumes2(op.Op) {
+			length2 += op.Length
+		}
+	}
+	return length1, length2
+}
+
+func consumes1(op byte) bool {
+	return op == 'M' || op == 'D' || op == 'N' || op == '=' || op == 'X'
+}
+
+func consumes2(op byte) bool {
+	return op == 'M' || op == 'I' || op == 'S' || op == 'H' || op == '=' || op == 'X'
+}
+
+// Appends the run, merging it with the last one of the same operation
+func (cigar Cigar) add(length int, op byte) Cigar {
+	if length <= 0 {
+		return cigar
+	}
+	if last := len(cigar) - 1; last >= 0 && cigar[last].Op == op {
+		cigar[last].Length += length
+		return cigar
+	}
+	return append(cigar, CigarOp{length, op})
+}
+
+// Parses the CIGAR string, "*" and "" are the empty CIGAR. Hard clips may only
+// be the first and the last operations, soft clips only follow or precede them
+func ParseCigar(cigar string) (Cigar, error) {
+	if cigar == "*" {
+		return nil, nil
+	}
+	var parsed Cigar
+	length, digits := 0, 0
+	for k := 0; k < len(cigar); k++ {
+		c := cigar[k]
+		if c >= '0' && c <= '9' {
+			length, digits = length*10+int(c-'0'), digits+1
+			if length > 1<<28 {
+				return nil, &CigarError{Cigar: cigar, Pos: k, Op: -1}
+			}
+			continue
+		}
+		if digits == 0 || length == 0 || strings.IndexByte(cigarOps, c) == -1 {
+			return nil, &CigarError{Cigar: cigar, Pos: k, Op: -1}
+		}
+		parsed = append(parsed, CigarOp{length, c})
+		length, digits = 0, 0
+	}
+	if digits > 0 {
+		return nil, &CigarError{Cigar: cigar, Pos: len(cigar), Op: -1}
+	}
+	// Clips go outside in: H, S, the alignment, S, H
+	for k, op := range parsed {
+		first, last := k == 0, k == len(parsed)-1
+		switch op.Op {
+		case 'H':
+			if !first && !last {
+				return nil, &CigarError{Cigar: cigar, Pos: -1, Op: k}
+			}
+		case 'S':
+			inner := (first || (k == 1 && parsed[0].Op == 'H')) ||
+				(last || (k == len(parsed)-2 && parsed[k+1].Op == 'H'))
+			if !inner {
+				return nil, &CigarError{Cigar: cigar, Pos: -1, Op: k}
+			}
+		}
+	}
+	return parsed, nil
+}
+
+// Extended CIGAR of the aligned rows with '=' and 'X' for the aligned residues
+func (engine *AlignEngine) RowsCigar(row1 string, row2 string) Cigar {
+	var cigar Cigar
+	for k := 0; k < len(row1); k++ {
+		switch {
+		case row1[k] == engine.GapChar:
+			cigar = cigar.add(1, 'I')
+		case row2[k] == engine.GapChar:
+			cigar = cigar.add(1, 'D')
+		case row1[k] == row2[k]:
+			cigar = cigar.add(1, '=')
+		default:
+			cigar = cigar.add(1, 'X')
+		}
+	}
+	return cigar
+}
+
+// CIGAR of the alignment within the whole seq2 of the given length,
+// the residues of seq2 outside of it are clipped with 'S' or 'H'
+func (alignment Alignment) ClippedCigar(length2 int, clip byte) (Cigar, error) {
+	cigar, err := ParseCigar(alignment.Cigar)
+	if err != nil {
+		return nil, err
+	}
+	clipped := Cigar(nil).add(alignment.Start2, clip)
+	clipped = append(clipped, cigar...)
+	return clipped.add(length2-alignment.End2, clip), nil
+}
+
+// Rebuilds the alignment of seq1 and seq2 from the CIGAR of seq2 against seq1,
+// the way a SAM record stores it: start1 is the 0-based position of the first
+// aligned residue of seq1, seq2 is the whole sequence with the clipped residues.
+// 'N' residues are written as deletions, '=' and 'X' must match the residues
+func (engine *AlignEngine) AlignmentFromCigar(seq1 string, seq2 string, start1 int, cigar string) (Alignment, error) {
+	parsed, err := ParseCigar(cigar)
+	if err != nil {
+		return Alignment{}, err
+	}
+	length1, length2 := parsed.Lengths()
+	if start1 < 0 || start1+length1 > len(seq1) || length2 != len(seq2) {
+		return Alignment{}, &CigarError{Cigar: cigar, Pos: -1, Op: -1}
+	}
+	var row1, row2 strings.Builder
+	i, j, start2 := start1, 0, 0
+	for k, op := range parsed {
+		switch op.Op {
+		case 'S', 'H':
+			// Leading clips move the start of the alignment in seq2
+			if row2.Len() == 0 && i == start1 {
+				start2 += op.Length
+			}
+			j += op.Length
+		case 'I':
+			row1.WriteString(strings.Repeat(string(engine.GapChar), op.Length))
+			row2.WriteString(seq2[j : j+op.Length])
+			j += op.Length
+		case 'D', 'N':
+			row1.WriteString(seq1[i : i+op.Length])
+			row2.WriteString(strings.Repeat(string(engine.GapChar), op.Length))
+			i += op.Length
+		case 'M', '=', 'X':
+			for n := 0; n < op.Length; n++ {
+				if equal := seq1[i+n] == seq2[j+n]; (op.Op == '=' && !equal) || (op.Op == 'X' && equal) {
+					return Alignment{}, &CigarError{Cigar: cigar, Pos: -1, Op: k}
+				}
+			}
+			row1.WriteString(seq1[i : i+op.Length])
+			row2.WriteString(seq2[j : j+op.Length])
+			i, j = i+op.Length, j+op.Length
+		}
+	}
+	score, err := engine.scoreRows(row1.String(), row2.String())
+	if err != nil {
+		return Alignment{}, err
+	}
+	return engine.newAlignment(row1.String(), row2.String(), start1, start2, score)
+}
@@ -0,0 +1,107 @@
+package algorithm
+
+import "context"
+
+// Rows of a DP table, or records of a search, between two checks of the context
+const cancelCheckRows = 64
+
+// Copy of the engine whose DP loops stop with the error of ctx once it is done
+func (engine *AlignEngine) withContext(ctx context.Context) *AlignEngine {
+	copied := *engine
+	copied.ctx = ctx
+	return &copied
+}
+
+// Error of the done context, checked on every cancelCheckRows row.
+// An engine without a context is never canceled
+func (engine *AlignEngine) canceled(row int) error {
+	if engine.ctx == nil || row%cancelCheckRows != 0 {
+		return nil
+	}
+	return engine.ctx.Err()
+}
+
+// Error of the done context, checked by the callers of the loops that stop early
+func (engine *AlignEngine) contextErr() error {
+	if engine.ctx == nil {
+		return nil
+	}
+	return engine.ctx.Err()
+}
+
+// Hirschberg that stops when ctx is done, returning its error
+func (engine *AlignEngine) HirschbergContext(ctx context.Context, seq1 string, seq2 string) (Alignment, error) {
+	return engine.withContext(ctx).Hirschberg(seq1, seq2)
+}
+
+// SmithWatermanLinear that stops when ctx is done, returning its error
+func (engine *AlignEngine) SmithWatermanLinearContext(ctx context.Context, seq1 string, seq2 string) (Alignment, error) {
+	return engine.withContext(ctx).SmithWatermanLinear(seq1, seq2)
+}
+
+// NeedlemanWunsch that stops when ctx is done, returning its error
+func (engine *AlignEngine) NeedlemanWunschContext(ctx context.Context, seq1 string, seq2 string) (Alignment, error) {
+	return engine.withContext(ctx).NeedlemanWunsch(seq1, seq2)
+}
+
+// SmithWaterman that stops when ctx is done, returning its error
+func (engine *AlignEngine) SmithWatermanContext(ctx context.Context, seq1 string, seq2 string) (Alignment, error) {
+	return engine.withContext(ctx).SmithWaterman(seq1, seq2)
+}
+
+// AlignSequences that stops when ctx is done, returning its error
+func (engine *AlignEngine) AlignSequencesContext(ctx context.Context, seq1 string, seq2 string, local bool) (Alignment, error) {
+	return engine.withContext(ctx).AlignSequences(seq1, seq2, local)
+}
+
+// Align that stops when ctx is done, returning its error
+func (engine *AlignEngine) AlignContext(ctx context.Context, seq1 string, seq2 string) (Alignment, error) {
+	return engine.withContext(ctx).Align(seq1, seq2)
+}
+
+// AlignBanded that stops when ctx is done, returning its error
+func (engine *AlignEngine) AlignBandedContext(ctx context.Context, seq1 string, seq2 string, bandwidth int) (Alignment, bool, error) {
+	return engine.withContext(ctx).AlignBanded(seq1, seq2, bandwidth)
+}
+
+// ExtendSeed that stops when ctx is done, returning its error
+func (engine *AlignEngine) ExtendSeedContext(ctx context.Context, seq1 string, seq2 string,
+	pos1 int, pos2 int, xDrop int) (Alignment, error) {
+	return engine.withContext(ctx).ExtendSeed(seq1, seq2, pos1, pos2, xDrop)
+}
+
+// AlignFrameshift that stops when ctx is done, returning its error
+func (engine *AlignEngine) AlignFrameshiftContext(ctx context.Context, dna string, protein string,
+	code *GeneticCode, frameshift int) (FrameshiftAlignment, error) {
+	return engine.withContext(ctx).AlignFrameshift(dna, protein, code, frameshift)
+}
+
+// MultiAlignSequences that stops when ctx is done, returning its error
+func (engine *AlignEngine) MultiAlignSequencesContext(ctx context.Context, template string, seqs []string) (Alignment, int, error) {
+	return engine.withContext(ctx).MultiAlignSequences(template, seqs)
+}
+
+// FastaSearch that stops when ctx is done. The error of ctx is returned
+// as it is, never as the *RecordError of the sequence being aligned
+func (engine *AlignEngine) FastaSearchContext(ctx context.Context, template string, seqs []Sequence,
+	params FastaParams) ([]FastaHit, error) {
+	return engine.withContext(ctx).FastaSearch(template, seqs, params)
+}
+
+// FastaSearchIndex that stops when ctx is done, see FastaSearchContext
+func (engine *AlignEngine) FastaSearchIndexContext(ctx context.Context, index *KmerIndex, seqs []Sequence,
+	params FastaParams) ([]FastaHit, error) {
+	return engine.withContext(ctx).FastaSearchIndex(index, seqs, params)
+}
+
+// TranslatedSearch that stops when ctx is done, see FastaSearchContext
+func (engine *AlignEngine) TranslatedSearchContext(ctx context.Context, template string, seqs []Sequence,
+	mode TranslatedMode, code *GeneticCode, params FastaParams) ([]FastaHit, error) {
+	return engine.withContext(ctx).TranslatedSearch(template, seqs, mode, code, params)
+}
+
+// MultiAlignTranslated that stops when ctx is done, returning its error
+func (engine *AlignEngine) MultiAlignTranslatedContext(ctx context.Context, template string, seqs []string,
+	mode TranslatedMode, code *GeneticCode) (Alignment, int, error) {
+	return engine.withContext(ctx).MultiAlignTranslated(template, seqs, mode, code)
+}
@@ -0,0 +1,76 @@
+package algorithm
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNoSequences   = errors.New("Sequences are empty!")
+	ErrEmptyTemplate = errors.New("Template length is 0!")
+	ErrEmptySequence = errors.New("Seq length is 0!")
+	ErrBandedLocal   = errors.New("Banded alignment is global or semi-global only")
+	ErrBandTooNarrow = errors.New("Alignment end is outside of the band")
+	ErrBadSeed       = errors.New("Seed position is outside of the sequences")
+	ErrFastaParams   = errors.New("FASTA ktup, regions and band must be positive")
+	ErrStrandProtein = errors.New("Minus strand search needs a nucleotide matrix")
+)
+
+// Residue unknown to the scoring scheme.
+// Seq is the number of the sequence (1 or 2) and Pos is 0-based position in it.
+// Score functions know neither, so they return Seq 0 and Pos -1,
+// the engine fills them in before returning the error
+type ResidueError struct {
+	Residue byte
+	Seq     int
+	Pos     int
+}
+
+func (err *ResidueError) Error() string {
+	if err.Pos < 0 {
+		return fmt.Sprintf("Bad character \"%c\" in sequence", err.Residue)
+	}
+	return fmt.Sprintf("Bad character \"%c\" at position %d of sequence %d",
+		err.Residue, err.Pos+1, err.Seq)
+}
+
+func newResidueError(residue byte) error {
+	return &ResidueError{Residue: residue, Pos: -1}
+}
+
+// Error in one of the sequences passed to MultiAlignSequences or FastaSearch,
+// Index is the position of the sequence in the slice
+type RecordError struct {
+	Index int
+	ID    string // Identifier of the record if it has one
+	Err   error
+}
+
+func (err *RecordError) Error() string {
+	if err.ID != "" {
+		return fmt.Sprintf("Sequence %s: %v", err.ID, err.Err)
+	}
+	return fmt.Sprintf("Sequence #%d: %v", err.Index, err.Err)
+}
+
+func (err *RecordError) Unwrap() error {
+	return err.Err
+}
+
+// Malformed CIGAR or one that does not fit the sequences.
+// Pos is the byte of a syntax error, Op the operation that does not fit,
+// both are -1 when the CIGAR lengths do not match the sequences
+type CigarError struct {
+	Cigar string
+	Pos   int
+	Op    int
+}
+
+func (err *CigarError) Error() string {
+	if err.Pos >= 0 {
+		return fmt.Sprintf("Bad CIGAR \"%s\" at character %d", err.Cigar, err.Pos+1)
+	} else if err.Op >= 0 {
+		return fmt.Sprintf("CIGAR \"%s\" operation %d does not fit the sequences", err.Cigar, err.Op+1)
+	}
+	return fmt.Sprintf("CIGAR \"%s\" lengths do not match the sequences", err.Cigar)
+}
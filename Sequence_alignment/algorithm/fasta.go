@@ -0,0 +1,406 @@
+package algorithm
+
+import (
+	"Bioinformatics/Sequence_alignment/utils"
+	"math"
+	"sort"
+)
+
+// Parameters of the FASTA heuristic (Pearson and Lipman, 1988)
+type FastaParams struct {
+	Ktup    int    // Length of the words looked up in the template
+	Regions int    // Best diagonal regions rescored for init1 and joined for initn
+	JoinGap int    // Score of joining two regions for initn, negative
+	Band    int    // Half width of the opt band around the best init1 region
+	Strand  Strand // Strands of nucleotide library sequences, Plus for proteins
+	// Leaves ZScore, Bits and EValue unset, for the parts of a library
+	// whose statistics the caller fits over the whole of it
+	SkipStats bool
+}
+
+// Defaults of fasta36 for protein search
+func DefaultFastaParams() FastaParams {
+	return FastaParams{
+		Ktup:    2,
+		Regions: 10,
+		JoinGap: -20,
+		Band:    16,
+	}
+}
+
+// Scores of one library sequence against the template, named as fasta36 reports them.
+// Init1 is the best diagonal region rescored with the substitution matrix,
+// Initn joins compatible regions, Opt is the banded Smith-Waterman score around
+// the init1 region. ZScore, Bits and EValue are filled by SetFastaStats
+type FastaHit struct {
+	Index       int // Number of the sequence in the library, starting from 0
+	ID          string
+	Description string
+	Length      int // Length of the library sequence
+	Initn       int
+	Init1       int
+	Opt         int
+	Strand      Strand // Plus or Minus, the strand of the library sequence in the alignment or of the translated frame
+	Frame       int    // Reading frame of the translated side of TranslatedSearch, 0 untranslated
+	// Range of the translated nucleotide sequence covered by the alignment, on its forward strand
+	NucleotideStart, NucleotideEnd int
+	ZScore                         float64
+	Bits                           float64
+	EValue                         float64
+	Alignment                      Alignment // Template in Row1 against the library sequence in Row2, reverse complemented on Minus
+	// *RecordError of a sequence that could not be aligned,
+	// such a hit has no scores and the statistics leave it out
+	Err error
+}
+
+// Ungapped run of word hits on the diagonal i - j = diag,
+// covering seq2[start:end]
+type diagRegion struct {
+	diag       int
+	start, end int
+	score      int
+}
+
+// Every residue between two word hits on the same diagonal scores this
+const regionDistanceScore = -1
+
+// Scores every sequence against the template with the FASTA heuristic
+// and estimates the statistics of the hits. Errors of particular sequences
+// are set as *RecordError in Err of their hits, the other sequences are still searched
+func (engine *AlignEngine) FastaSearch(template string, seqs []Sequence, params FastaParams) ([]FastaHit, error) {
+	if len(template) == 0 {
+		return nil, ErrEmptyTemplate
+	} else if params.Ktup < 1 {
+		return nil, ErrFastaParams
+	}
+	if engine.Matrix == nil {
+		return nil, errNoMatrix
+	}
+	index, err := NewKmerIndex(engine.Matrix, template, params.Ktup)
+	if err != nil {
+		return nil, err
+	}
+	return engine.FastaSearchIndex(index, seqs, params)
+}
+
+// FastaSearch with the template index built once, so that it can be shared
+// between the parts of a library. The index must use the engine matrix and params.Ktup
+func (engine *AlignEngine) FastaSearchIndex(index *KmerIndex, seqs []Sequence, params FastaParams) ([]FastaHit, error) {
+	if len(seqs) == 0 {
+		return nil, ErrNoSequences
+	} else if len(index.template.enc) == 0 {
+		return nil, ErrEmptyTemplate
+	} else if params.Ktup != index.K || params.Regions < 1 || params.Band < 1 || index.Matrix != engine.Matrix ||
+		params.Strand < Plus || params.Strand > Both {
+		return nil, ErrFastaParams
+	} else if params.Strand != Plus && !engine.Matrix.IsNucleotide() {
+		return nil, ErrStrandProtein
+	}
+	templ := index.template
+	hits := make([]FastaHit, len(seqs))
+	for i, seq := range seqs {
+		var err error
+		if err = engine.canceled(i); err != nil {
+			return nil, err
+		}
+		if len(seq.Residues) == 0 {
+			err = ErrEmptySequence
+		} else {
+			hits[i], err = engine.fastaStrands(index, seq.Residues, params)
+		}
+		if ctxErr := engine.contextErr(); ctxErr != nil {
+			return nil, ctxErr
+		} else if err != nil {
+			hits[i] = FastaHit{Err: &RecordError{Index: i, ID: seq.ID, Err: err}}
+		}
+		hits[i].Index, hits[i].ID, hits[i].Description = i, seq.ID, seq.Description
+	}
+	if !params.SkipStats {
+		SetFastaStats(hits, len(templ.enc))
+	}
+	return hits, nil
+}
+
+// FASTA hit of the library sequence on the strands of params,
+// the minus strand wins only with a higher opt score
+func (engine *AlignEngine) fastaStrands(index *KmerIndex, residues string, params FastaParams) (FastaHit, error) {
+	var best FastaHit
+	for _, strand := range []Strand{Plus, Minus} {
+		if params.Strand != Both && params.Strand != strand {
+			continue
+		}
+		if strand == Minus {
+			residues = utils.ReverseComplement(residues)
+		}
+		encoded, err := engine.encode("", residues)
+		if err != nil {
+			return FastaHit{}, err
+		}
+		hit, err := engine.fastaHit(index, encoded[1], params)
+		if err != nil {
+			return FastaHit{}, err
+		}
+		hit.Strand = strand
+		if strand == Plus || params.Strand == Minus || hit.Opt > best.Opt {
+			best = hit
+		}
+	}
+	return best, nil
+}
+
+// FASTA stages for one library sequence
+func (engine *AlignEngine) fastaHit(index *KmerIndex, seq encodedSeq, params FastaParams) (FastaHit, error) {
+	templ := index.template
+	hit := FastaHit{Length: len(seq.enc)}
+	regions := engine.diagRegions(index, seq, params)
+	if len(regions) == 0 {
+		return hit, nil
+	}
+	best := 0
+	for k := range regions {
+		regions[k] = engine.rescoreRegion(templ, seq, regions[k])
+		if regions[k].score > regions[best].score {
+			best = k
+		}
+	}
+	hit.Init1 = regions[best].score
+	hit.Initn = joinRegions(regions, params.JoinGap)
+
+	t, score, iEnd, jEnd := engine.fillBand(templ, seq, true, EndGaps{}, params.Band, regions[best].diag)
+	hit.Opt = score
+	if err := engine.contextErr(); err != nil {
+		return FastaHit{}, err
+	} else if score <= 0 {
+		return hit, nil
+	}
+	alignment, err := engine.findAlign(templ, seq, t, true, EndGaps{}, iEnd, jEnd)
+	if err != nil {
+		return FastaHit{}, err
+	}
+	hit.Alignment = alignment
+	return hit, nil
+}
+
+// Finds the runs of ktup word hits along every diagonal and returns the best of them.
+// A run scores its word residues with the substitution matrix and regionDistanceScore
+// for the residues between words; it is closed when the score drops to zero
+func (engine *AlignEngine) diagRegions(index *KmerIndex, seq encodedSeq, params FastaParams) []diagRegion {
+	templ := index.template
+	ktup := index.K
+	diags := len(templ.enc) + len(seq.enc)
+	// State of the run on every diagonal, indexed by i - j + len(seq)
+	score := make([]int, diags)
+	end := make([]int, diags)
+	open := make([]diagRegion, diags)
+	var regions []diagRegion
+	closeRun := func(d int) {
+		if open[d].score > 0 {
+			regions = append(regions, open[d])
+		}
+		open[d], score[d] = diagRegion{}, 0
+	}
+	index.eachHit(seq, func(i int, j int) {
+		d := i - j + len(seq.enc)
+		from := j
+		if score[d] > 0 {
+			if end[d] > from {
+				from = end[d]
+			} else {
+				score[d] += (j - end[d]) * regionDistanceScore
+			}
+		}
+		if score[d] <= 0 {
+			closeRun(d)
+			open[d].diag, open[d].start = i-j, j
+		}
+		for k := from; k < j+ktup; k++ {
+			score[d] += engine.Matrix.pair(templ.enc[k+i-j], seq.enc[k])
+		}
+		end[d] = j + ktup
+		if score[d] > open[d].score {
+			open[d].score, open[d].end = score[d], end[d]
+		}
+	})
+	for d := range open {
+		closeRun(d)
+	}
+	sort.SliceStable(regions, func(a, b int) bool {
+		return regions[a].score > regions[b].score
+	})
+	if len(regions) > params.Regions {
+		regions = regions[:params.Regions]
+	}
+	return regions
+}
+
+// Best ungapped segment of the region under the substitution matrix (init1 of the region)
+func (engine *AlignEngine) rescoreRegion(templ encodedSeq, seq encodedSeq, region diagRegion) diagRegion {
+	best := diagRegion{diag: region.diag}
+	score, start := 0, region.start
+	for j := region.start; j < region.end; j++ {
+		score += engine.Matrix.pair(templ.enc[j+region.diag], seq.enc[j])
+		if score <= 0 {
+			score, start = 0, j+1
+		} else if score > best.score {
+			best.score, best.start, best.end = score, start, j+1
+		}
+	}
+	return best
+}
+
+// Initn: the best chain of regions following each other in both sequences,
+// every join scores joinGap
+func joinRegions(regions []diagRegion, joinGap int) int {
+	sorted := append([]diagRegion(nil), regions...)
+	sort.SliceStable(sorted, func(a, b int) bool {
+		return sorted[a].start < sorted[b].start
+	})
+	chain := make([]int, len(sorted))
+	initn := 0
+	for b, region := range sorted {
+		chain[b] = region.score
+		for a := 0; a < b; a++ {
+			prev := sorted[a]
+			if prev.end <= region.start && prev.end+prev.diag <= region.start+region.diag &&
+				chain[a]+joinGap > 0 && chain[a]+joinGap+region.score > chain[b] {
+				chain[b] = chain[a] + joinGap + region.score
+			}
+		}
+		if chain[b] > initn {
+			initn = chain[b]
+		}
+	}
+	return initn
+}
+
+// Hits more than this many deviations above the regression line
+// are excluded from it, like the related sequences fasta36 censors
+const statsOutlier = 3
+
+// Fills ZScore, Bits and EValue of the hits with the statistics fitted over them,
+// hits with Err set are left out
+func SetFastaStats(hits []FastaHit, queryLength int) {
+	stats := FitFastaStats(hits, queryLength)
+	for k := range hits {
+		if hits[k].Err == nil {
+			stats.Apply(&hits[k])
+		}
+	}
+}
+
+// Score distribution of a library the way fasta36 estimates it: opt scores are
+// regressed on the logarithm of the library sequence length, the residuals
+// are normalised to mean 50 and deviation 10 and follow the extreme value distribution
+type FastaStats struct {
+	Library     int // Number of the library sequences
+	QueryLength int
+	fit         lengthFit
+}
+
+// Opt score of a hit and the length of its library sequence, all the statistics need of it
+type HitScore struct {
+	Opt    int
+	Length int
+}
+
+// Score of the hit for FitScoreStats
+func (hit FastaHit) Score() HitScore {
+	return HitScore{Opt: hit.Opt, Length: hit.Length}
+}
+
+// Fits the statistics over the hits of every library sequence.
+// Hits with Err set are not counted
+func FitFastaStats(hits []FastaHit, queryLength int) FastaStats {
+	scores := make([]HitScore, 0, len(hits))
+	for _, hit := range hits {
+		if hit.Err == nil {
+			scores = append(scores, hit.Score())
+		}
+	}
+	return FitScoreStats(scores, queryLength)
+}
+
+// FitFastaStats over the scores of the hits, so that a search
+// does not have to keep the hits of the whole library
+func FitScoreStats(scores []HitScore, queryLength int) FastaStats {
+	stats := FastaStats{Library: len(scores), QueryLength: queryLength}
+	included := make([]bool, len(scores))
+	for k := range included {
+		included[k] = true
+	}
+	for {
+		stats.fit = fitLength(scores, included)
+		changed := false
+		for k, score := range scores {
+			if included[k] && stats.fit.z(score) > statsOutlier {
+				included[k], changed = false, true
+			}
+		}
+		if !changed {
+			return stats
+		}
+	}
+}
+
+// Fills ZScore, Bits and EValue of the hit
+func (stats FastaStats) Apply(hit *FastaHit) {
+	const eulerGamma = 0.5772156649
+	z := stats.fit.z(hit.Score())
+	hit.ZScore = 50 + 10*z
+	// Probability of the score in one comparison,
+	// its logarithm is -u once p is too small for a float
+	u := math.Pi/math.Sqrt(6)*z + eulerGamma
+	p := -math.Expm1(-math.Exp(-u))
+	logP := -u
+	if p > 0 {
+		logP = math.Log(p)
+	}
+	hit.EValue = float64(stats.Library) * p
+	hit.Bits = math.Log2(float64(stats.QueryLength)*float64(hit.Length)) - logP/math.Ln2
+}
+
+// Linear regression of opt scores on the logarithm of the length
+type lengthFit struct {
+	slope, intercept, deviation float64
+}
+
+func fitLength(scores []HitScore, included []bool) lengthFit {
+	var n, sumX, sumY, sumXX, sumXY float64
+	for k, hit := range scores {
+		if !included[k] {
+			continue
+		}
+		x, y := math.Log(float64(hit.Length)), float64(hit.Opt)
+		n++
+		sumX += x
+		sumY += y
+		sumXX += x * x
+		sumXY += x * y
+	}
+	var fit lengthFit
+	if n == 0 {
+		return fit
+	}
+	// All lengths equal leave the slope undefined
+	if det := n*sumXX - sumX*sumX; det > 1e-9*n*sumXX {
+		fit.slope = (n*sumXY - sumX*sumY) / det
+	}
+	fit.intercept = (sumY - fit.slope*sumX) / n
+	var variance float64
+	for k, hit := range scores {
+		if included[k] {
+			residual := float64(hit.Opt) - fit.intercept - fit.slope*math.Log(float64(hit.Length))
+			variance += residual * residual
+		}
+	}
+	fit.deviation = math.Sqrt(variance / n)
+	return fit
+}
+
+// Residual of the hit in deviations, 0 when the scores do not deviate
+func (fit lengthFit) z(hit HitScore) float64 {
+	if fit.deviation == 0 {
+		return 0
+	}
+	return (float64(hit.Opt) - fit.intercept - fit.slope*math.Log(float64(hit.Length))) / fit.deviation
+}
@@ -0,0 +1,174 @@
+package algorithm
+
+import (
+	"Bioinformatics/Sequence_alignment/utils"
+	"strings"
+)
+
+// Frameshift penalty of fasty with BLOSUM62 scores
+const DefaultFrameshiftPenalty = -20
+
+// Change of the reading frame inside a frameshift alignment.
+// Shift +1 skips the nucleotide at Pos, an insertion in the DNA,
+// Shift -1 reads the nucleotide at Pos twice, a deletion from the DNA.
+// Column is the alignment column of the codon following the shift
+type Frameshift struct {
+	Pos    int
+	Shift  int
+	Column int
+}
+
+// Local alignment of a DNA sequence against a protein. Row1 holds the
+// translated codons and Row2 the protein, Start1 and End1 are nucleotide
+// positions and the rest of the alignment counts residues
+type FrameshiftAlignment struct {
+	Alignment
+	Frameshifts []Frameshift
+}
+
+// Aligns the codons of the forward strand of dna to the protein in the style
+// of fasty: a codon aligned to a residue may follow the previous codon one
+// nucleotide later or earlier than its reading frame, scoring the frameshift
+// penalty, gaps are whole codons or residues. A nil code is the standard one
+func (engine *AlignEngine) AlignFrameshift(dna string, protein string, code *GeneticCode,
+	frameshift int) (FrameshiftAlignment, error) {
+	if code == nil {
+		code = geneticCodes[1]
+	}
+	// codons[i] is the amino acid of dna[i:i+3]
+	codons := make([]byte, 0, len(dna))
+	for i := 0; i+3 <= len(dna); i++ {
+		codons = append(codons, code.Codon(dna[i], dna[i+1], dna[i+2]))
+	}
+	seqs, err := engine.encode(string(codons), protein)
+	if err != nil {
+		return FrameshiftAlignment{}, err
+	}
+	enc1, enc2 := seqs[0].enc, seqs[1].enc
+
+	// Tables are indexed [j][i] with i nucleotides and j residues aligned
+	height, width := len(protein)+1, len(dna)+1
+	t := newGotohTables(height, width)
+	for j := 0; j < height; j++ {
+		for i := 0; i < width; i++ {
+			t.m[j][i], t.x[j][i], t.y[j][i] = negInf, negInf, negInf
+		}
+	}
+	best := func(j int, i int) int {
+		score, _ := utils.Max(t.cell(j, i))
+		return score
+	}
+	iMax, jMax := 0, 0
+	for i := 0; i < width; i++ {
+		if err := engine.canceled(i); err != nil {
+			return FrameshiftAlignment{}, err
+		}
+		for j := 0; j < height; j++ {
+			if i >= 3 && j >= 1 {
+				prev, _ := utils.Max(0, best(j-1, i-3), best(j-1, i-2)+frameshift)
+				if i >= 4 {
+					prev, _ = utils.Max(prev, best(j-1, i-4)+frameshift)
+				}
+				t.m[j][i] = prev + engine.Matrix.pair(enc1[i-3], enc2[j-1])
+				if t.m[j][i] > t.m[jMax][iMax] {
+					iMax, jMax = i, j
+				}
+			}
+			if i >= 3 {
+				t.x[j][i], _ = utils.Max(
+					t.m[j][i-3]+engine.GapOpen,
+					t.x[j][i-3]+engine.GapExtend,
+					t.y[j][i-3]+engine.GapOpen,
+				)
+			}
+			if j >= 1 {
+				t.y[j][i], _ = utils.Max(
+					t.m[j-1][i]+engine.GapOpen,
+					t.x[j-1][i]+engine.GapOpen,
+					t.y[j-1][i]+engine.GapExtend,
+				)
+			}
+		}
+	}
+	if t.m[jMax][iMax] <= 0 {
+		return FrameshiftAlignment{}, nil
+	}
+
+	// Traceback until the match that starts the local alignment,
+	// the rows and the frameshifts are collected from the end
+	var row1, row2 strings.Builder
+	var shifts []Frameshift
+	i, j, state := iMax, jMax, stateM
+	for started := false; !started; {
+		switch state {
+		case stateM:
+			row1.WriteByte(codons[i-3])
+			row2.WriteByte(protein[j-1])
+			target := t.m[j][i] - engine.Matrix.pair(enc1[i-3], enc2[j-1])
+			step := 3
+			if target == 0 {
+				started = true
+			} else if best(j-1, i-3) != target {
+				// The codon continues a shifted frame
+				step, target = 2, target-frameshift
+				if i >= 4 && best(j-1, i-4) == target {
+					step = 4
+					shifts = append(shifts, Frameshift{Pos: i - 4, Shift: 1, Column: row1.Len() - 1})
+				} else {
+					shifts = append(shifts, Frameshift{Pos: i - 3, Shift: -1, Column: row1.Len() - 1})
+				}
+			}
+			i, j = i-step, j-1
+			state = previousState(t, j, i, target)
+		case stateX:
+			row1.WriteByte(codons[i-3])
+			row2.WriteByte(engine.GapChar)
+			score := t.x[j][i]
+			i -= 3
+			state = gapPreviousState(t.m[j][i]+engine.GapOpen == score, t.x[j][i]+engine.GapExtend == score, stateX)
+		case stateY:
+			row1.WriteByte(engine.GapChar)
+			row2.WriteByte(protein[j-1])
+			score := t.y[j][i]
+			j--
+			state = gapPreviousState(t.m[j][i]+engine.GapOpen == score, t.y[j][i]+engine.GapExtend == score, stateY)
+		}
+	}
+	length := row1.Len()
+	for k := range shifts {
+		shifts[k].Column = length - 1 - shifts[k].Column
+	}
+	for l, r := 0, len(shifts)-1; l < r; l, r = l+1, r-1 {
+		shifts[l], shifts[r] = shifts[r], shifts[l]
+	}
+	alignment, err := engine.newAlignment(reverseBytes(row1.String()), reverseBytes(row2.String()), 0, j, t.m[jMax][iMax])
+	if err != nil {
+		return FrameshiftAlignment{}, err
+	}
+	alignment.Start1, alignment.End1 = i, iMax
+	return FrameshiftAlignment{Alignment: alignment, Frameshifts: shifts}, nil
+}
+
+// State of the cell (i, j) holding the given score, a match preferred
+func previousState(t gotohTables, j int, i int, score int) int {
+	switch score {
+	case t.m[j][i]:
+		return stateM
+	case t.x[j][i]:
+		return stateX
+	}
+	return stateY
+}
+
+// State a gap came from: a match, the same gap extended, or the other gap
+func gapPreviousState(fromMatch bool, extended bool, gap int) int {
+	switch {
+	case fromMatch:
+		return stateM
+	case extended:
+		return gap
+	case gap == stateX:
+		return stateY
+	}
+	return stateX
+}
@@ -0,0 +1,156 @@
+package algorithm
+
+import (
+	"Bioinformatics/Sequence_alignment/utils"
+	"fmt"
+	"sort"
+)
+
+// Genetic code of the NCBI translation tables. AminoAcids holds the
+// translations of the 64 codons ordered TTT, TTC, TTA, TTG, TCT, ... GGG
+// the way the NCBI gc.prt lists them, '*' is a stop codon. Codes 27, 28
+// and 31 read their context-dependent stops as the amino acids, the way NCBI does
+type GeneticCode struct {
+	ID         int
+	Name       string
+	AminoAcids string
+}
+
+var geneticCodes = map[int]*GeneticCode{}
+
+func init() {
+	for _, code := range []GeneticCode{
+		{1, "Standard", "FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{2, "Vertebrate Mitochondrial", "FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSS**VVVVAAAADDEEGGGG"},
+		{3, "Yeast Mitochondrial", "FFLLSSSSYY**CCWWTTTTPPPPHHQQRRRRIIMMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{4, "Mold, Protozoan, Coelenterate Mitochondrial and Mycoplasma", "FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{5, "Invertebrate Mitochondrial", "FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSSSSVVVVAAAADDEEGGGG"},
+		{6, "Ciliate, Dasycladacean and Hexamita Nuclear", "FFLLSSSSYYQQCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{9, "Echinoderm and Flatworm Mitochondrial", "FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNNKSSSSVVVVAAAADDEEGGGG"},
+		{10, "Euplotid Nuclear", "FFLLSSSSYY**CCCWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{11, "Bacterial, Archaeal and Plant Plastid", "FFLLSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{12, "Alternative Yeast Nuclear", "FFLLSSSSYY**CC*WLLLSPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{13, "Ascidian Mitochondrial", "FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNKKSSGGVVVVAAAADDEEGGGG"},
+		{14, "Alternative Flatworm Mitochondrial", "FFLLSSSSYYY*CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNNKSSSSVVVVAAAADDEEGGGG"},
+		{15, "Blepharisma Nuclear", "FFLLSSSSYY*QCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{16, "Chlorophycean Mitochondrial", "FFLLSSSSYY*LCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{21, "Trematode Mitochondrial", "FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIMMTTTTNNNKSSSSVVVVAAAADDEEGGGG"},
+		{22, "Scenedesmus obliquus Mitochondrial", "FFLLSS*SYY*LCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{23, "Thraustochytrium Mitochondrial", "FF*LSSSSYY**CC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{24, "Rhabdopleuridae Mitochondrial", "FFLLSSSSYY**CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSSKVVVVAAAADDEEGGGG"},
+		{25, "Candidate Division SR1 and Gracilibacteria", "FFLLSSSSYY**CCGWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{26, "Pachysolen tannophilus Nuclear", "FFLLSSSSYY**CC*WLLLAPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{27, "Karyorelict Nuclear", "FFLLSSSSYYQQCCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{28, "Condylostoma Nuclear", "FFLLSSSSYYQQCCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{29, "Mesodinium Nuclear", "FFLLSSSSYYYYCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{30, "Peritrich Nuclear", "FFLLSSSSYYEECC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{31, "Blastocrithidia Nuclear", "FFLLSSSSYYEECCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{32, "Balanophoraceae Plastid", "FFLLSSSSYY*WCC*WLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSRRVVVVAAAADDEEGGGG"},
+		{33, "Cephalodiscidae Mitochondrial", "FFLLSSSSYYY*CCWWLLLLPPPPHHQQRRRRIIIMTTTTNNKKSSSKVVVVAAAADDEEGGGG"},
+	} {
+		code := code
+		geneticCodes[code.ID] = &code
+	}
+}
+
+// The genetic code by its NCBI transl_table number
+func LookupGeneticCode(id int) (*GeneticCode, error) {
+	if code, ok := geneticCodes[id]; ok {
+		return code, nil
+	}
+	return nil, fmt.Errorf("Unknown genetic code %d, see NCBI transl_table numbers %v", id, GeneticCodeIDs())
+}
+
+// Numbers of the genetic codes in ascending order
+func GeneticCodeIDs() []int {
+	ids := make([]int, 0, len(geneticCodes))
+	for id := range geneticCodes {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// Bases each IUPAC code stands for, in the TCAG order of the tables
+var iupacBases = map[byte]string{
+	'T': "T", 'U': "T", 'C': "C", 'A': "A", 'G': "G",
+	'R': "AG", 'Y': "TC", 'S': "CG", 'W': "TA", 'K': "TG", 'M': "CA",
+	'B': "TCG", 'D': "TAG", 'H': "TCA", 'V': "CAG", 'N': "TCAG",
+}
+
+func baseIndex(base byte) int {
+	switch base {
+	case 'T':
+		return 0
+	case 'C':
+		return 1
+	case 'A':
+		return 2
+	}
+	return 3
+}
+
+// Amino acid of the codon. Ambiguous codons translate to the amino acid
+// every possible codon agrees on, 'X' otherwise, e.g. for gaps
+func (code *GeneticCode) Codon(a byte, b byte, c byte) byte {
+	var bases [3]string
+	for k, base := range []byte{a, b, c} {
+		if base >= 'a' && base <= 'z' {
+			base -= 'a' - 'A'
+		}
+		var ok bool
+		if bases[k], ok = iupacBases[base]; !ok {
+			return 'X'
+		}
+	}
+	aa := byte(0)
+	for _, x := range []byte(bases[0]) {
+		for _, y := range []byte(bases[1]) {
+			for _, z := range []byte(bases[2]) {
+				next := code.AminoAcids[16*baseIndex(x)+4*baseIndex(y)+baseIndex(z)]
+				if aa != 0 && aa != next {
+					return 'X'
+				}
+				aa = next
+			}
+		}
+	}
+	return aa
+}
+
+// Translation of the reading frame 1, 2 or 3 of the sequence,
+// or -1, -2, -3 of its reverse complement. Incomplete codons are dropped
+func (code *GeneticCode) Translate(dna string, frame int) string {
+	if frame < 0 {
+		dna, frame = utils.ReverseComplement(dna), -frame
+	}
+	if frame < 1 || frame > 3 || len(dna) < frame+2 {
+		return ""
+	}
+	protein := make([]byte, 0, (len(dna)-frame+1)/3)
+	for k := frame - 1; k+3 <= len(dna); k += 3 {
+		protein = append(protein, code.Codon(dna[k], dna[k+1], dna[k+2]))
+	}
+	return string(protein)
+}
+
+// Nucleotide range [start, end) of the forward strand coded by the residues
+// [start, end) of the frame translation of a sequence of the given length
+func FrameToNucleotide(frame int, start int, end int, length int) (int, int) {
+	if frame > 0 {
+		return frame - 1 + 3*start, frame - 1 + 3*end
+	}
+	offset := -frame - 1
+	return length - offset - 3*end, length - offset - 3*start
+}
+
+// Reading frames of the strand: 1, 2, 3 on Plus, -1, -2, -3 on Minus
+func (strand Strand) Frames() []int {
+	switch strand {
+	case Plus:
+		return []int{1, 2, 3}
+	case Minus:
+		return []int{-1, -2, -3}
+	}
+	return []int{1, 2, 3, -1, -2, -3}
+}
@@ -0,0 +1,109 @@
+package algorithm
+
+import (
+	"fmt"
+	"math"
+	"sort"
+)
+
+// Positions of every k-mer of the template, built once and shared by all
+// the sequences searched against it. K-mers are packed into integers
+// of the matrix alphabet, so memory is linear in the template length
+// and looking up a sequence is linear in the number of its word hits
+type KmerIndex struct {
+	K         int
+	Matrix    *SubstitutionMatrix
+	template  encodedSeq
+	positions map[uint64][]int
+}
+
+// Indexes the k-mers of the template residues encoded with the matrix
+func NewKmerIndex(matrix *SubstitutionMatrix, template string, k int) (*KmerIndex, error) {
+	if matrix == nil {
+		return nil, errNoMatrix
+	}
+	size := len(matrix.Alphabet)
+	if k < 1 || float64(k)*math.Log2(float64(size)) >= 64 {
+		return nil, fmt.Errorf("Word length %d is out of range for %d residues", k, size)
+	}
+	enc, err := matrix.Encode(template)
+	if err != nil {
+		return nil, err
+	}
+	index := &KmerIndex{
+		K:         k,
+		Matrix:    matrix,
+		template:  encodedSeq{template, enc},
+		positions: make(map[uint64][]int),
+	}
+	index.eachKmer(enc, func(pos int, code uint64) {
+		index.positions[code] = append(index.positions[code], pos)
+	})
+	return index, nil
+}
+
+// Calls visit with the packed code of every k-mer of the encoded sequence
+func (index *KmerIndex) eachKmer(enc []byte, visit func(pos int, code uint64)) {
+	size := uint64(len(index.Matrix.Alphabet))
+	// Weight of the residue leaving the window
+	high := uint64(1)
+	for k := 1; k < index.K; k++ {
+		high *= size
+	}
+	var code uint64
+	for pos, c := range enc {
+		if pos >= index.K {
+			code -= uint64(enc[pos-index.K]) * high
+		}
+		code = code*size + uint64(c)
+		if pos+1 >= index.K {
+			visit(pos+1-index.K, code)
+		}
+	}
+}
+
+// Calls visit for every word hit: the k-mers template[i:i+K] and seq[j:j+K] are equal.
+// Hits come in the order of j, the hits of one j in the order of i
+func (index *KmerIndex) eachHit(seq encodedSeq, visit func(i int, j int)) {
+	index.eachKmer(seq.enc, func(j int, code uint64) {
+		for _, i := range index.positions[code] {
+			visit(i, j)
+		}
+	})
+}
+
+// Word hits of the sequence grouped by diagonal i - j, every list holds
+// the positions j in the sequence in increasing order
+func (index *KmerIndex) DiagonalHits(seq string) (map[int][]int, error) {
+	enc, err := index.Matrix.Encode(seq)
+	if err != nil {
+		return nil, err
+	}
+	diagonals := make(map[int][]int)
+	index.eachHit(encodedSeq{seq, enc}, func(i int, j int) {
+		diagonals[i-j] = append(diagonals[i-j], j)
+	})
+	return diagonals, nil
+}
+
+// Diagonal with the most word hits, and the first and the last of them.
+// Ties go to the lowest diagonal
+func BestDiagonal(diagonals map[int][]int) (int, int, Coordinate, Coordinate) {
+	keys := make([]int, 0, len(diagonals))
+	for diag := range diagonals {
+		keys = append(keys, diag)
+	}
+	sort.Ints(keys)
+	count, best := 0, 0
+	for _, diag := range keys {
+		if len(diagonals[diag]) > count {
+			count, best = len(diagonals[diag]), diag
+		}
+	}
+	if count == 0 {
+		return 0, 0, Coordinate{}, Coordinate{}
+	}
+	hits := diagonals[best]
+	first, last := hits[0], hits[len(hits)-1]
+	return count, best, Coordinate{I: first + best, J: first}, Coordinate{I: last + best, J: last}
+}
@@ -0,0 +1,199 @@
+package algorithm
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Substitution scores compiled into a lookup table.
+// Sequences are encoded to residue indices in Alphabet once before alignment,
+// so scoring a pair inside the dynamic programming loops is a single slice access
+type SubstitutionMatrix struct {
+	Name     string
+	Alphabet string
+	index    [256]int16 // Index of every byte in Alphabet, -1 if absent
+	scores   []int      // len(Alphabet) x len(Alphabet), row by row
+}
+
+// Compiles the matrix from the square table of weights,
+// weights[i][j] is the score of Alphabet[i] against Alphabet[j].
+// Lower case letters are scored as upper case ones unless the alphabet has both
+func NewSubstitutionMatrix(name string, alphabet string, weights [][]int) (*SubstitutionMatrix, error) {
+	if len(alphabet) == 0 || len(alphabet) > 256 {
+		return nil, fmt.Errorf("Matrix %s: alphabet must have 1 to 256 residues, got %d", name, len(alphabet))
+	}
+	if len(weights) != len(alphabet) {
+		return nil, fmt.Errorf("Matrix %s: %d rows for %d residues", name, len(weights), len(alphabet))
+	}
+	matrix := &SubstitutionMatrix{
+		Name:     name,
+		Alphabet: alphabet,
+		scores:   make([]int, len(alphabet)*len(alphabet)),
+	}
+	for c := range matrix.index {
+		matrix.index[c] = -1
+	}
+	for i := 0; i < len(alphabet); i++ {
+		if matrix.index[alphabet[i]] != -1 {
+			return nil, fmt.Errorf("Matrix %s: residue \"%c\" is repeated", name, alphabet[i])
+		}
+		matrix.index[alphabet[i]] = int16(i)
+	}
+	for i := 0; i < len(alphabet); i++ {
+		c := alphabet[i]
+		if c >= 'A' && c <= 'Z' && matrix.index[c-'A'+'a'] == -1 {
+			matrix.index[c-'A'+'a'] = int16(i)
+		}
+	}
+	for i, row := range weights {
+		if len(row) != len(alphabet) {
+			return nil, fmt.Errorf("Matrix %s: row \"%c\" has %d columns for %d residues",
+				name, alphabet[i], len(row), len(alphabet))
+		}
+		copy(matrix.scores[i*len(alphabet):], row)
+	}
+	return matrix, nil
+}
+
+// Adapter for custom scoring: compiles the score function into a matrix.
+// A byte is in the alphabet if the function scores it against itself without an error.
+// Pairs of such bytes the function still fails on are never aligned to each other
+func MatrixFromFunc(name string, scoreFunc ScoreFuncType) *SubstitutionMatrix {
+	var alphabet []byte
+	for c := 0; c < 256; c++ {
+		if _, err := scoreFunc(byte(c), byte(c)); err == nil {
+			alphabet = append(alphabet, byte(c))
+		}
+	}
+	weights := make([][]int, len(alphabet))
+	for i, a := range alphabet {
+		weights[i] = make([]int, len(alphabet))
+		for j, b := range alphabet {
+			score, err := scoreFunc(a, b)
+			if err != nil {
+				score = negInf
+			}
+			weights[i][j] = score
+		}
+	}
+	matrix, err := NewSubstitutionMatrix(name, string(alphabet), weights)
+	if err != nil {
+		// Only a function that fails on every byte gets here,
+		// such a matrix rejects every residue
+		matrix = &SubstitutionMatrix{Name: name}
+		for c := range matrix.index {
+			matrix.index[c] = -1
+		}
+	}
+	return matrix
+}
+
+// Whether the matrix scores nucleotides: its alphabet has letters
+// and all of them are IUPAC nucleotide codes
+func (matrix *SubstitutionMatrix) IsNucleotide() bool {
+	letters := 0
+	for i := 0; i < len(matrix.Alphabet); i++ {
+		c := matrix.Alphabet[i]
+		if c >= 'a' && c <= 'z' {
+			c -= 'a' - 'A'
+		}
+		if c < 'A' || c > 'Z' {
+			continue
+		}
+		if strings.IndexByte("ACGTURYSWKMBDHVN", c) == -1 {
+			return false
+		}
+		letters++
+	}
+	return letters > 0
+}
+
+// Panics on error, only for the matrices built into the package
+func mustMatrix(matrix *SubstitutionMatrix, err error) *SubstitutionMatrix {
+	if err != nil {
+		panic(err)
+	}
+	return matrix
+}
+
+// Score of two residues. Has the ScoreFuncType signature,
+// so the matrix can be used wherever a score function is expected
+func (matrix *SubstitutionMatrix) Score(a byte, b byte) (int, error) {
+	i := matrix.index[a]
+	if i == -1 {
+		return 0, newResidueError(a)
+	}
+	j := matrix.index[b]
+	if j == -1 {
+		return 0, newResidueError(b)
+	}
+	return matrix.scores[int(i)*len(matrix.Alphabet)+int(j)], nil
+}
+
+// Converts residues to their indices in the alphabet.
+// Unknown residue is reported as *ResidueError with its position
+func (matrix *SubstitutionMatrix) Encode(seq string) ([]byte, error) {
+	encoded := make([]byte, len(seq))
+	for pos := 0; pos < len(seq); pos++ {
+		i := matrix.index[seq[pos]]
+		if i == -1 {
+			return nil, &ResidueError{Residue: seq[pos], Pos: pos}
+		}
+		encoded[pos] = byte(i)
+	}
+	return encoded, nil
+}
+
+// Score of two encoded residues
+func (matrix *SubstitutionMatrix) pair(a byte, b byte) int {
+	return matrix.scores[int(a)*len(matrix.Alphabet)+int(b)]
+}
+
+// Sequence prepared for alignment: original residues and their matrix indices
+type encodedSeq struct {
+	raw string
+	enc []byte
+}
+
+func (seq encodedSeq) slice(from int, to int) encodedSeq {
+	return encodedSeq{seq.raw[from:to], seq.enc[from:to]}
+}
+
+func (seq encodedSeq) reversed() encodedSeq {
+	enc := make([]byte, len(seq.enc))
+	for i, c := range seq.enc {
+		enc[len(enc)-1-i] = c
+	}
+	return encodedSeq{reverseBytes(seq.raw), enc}
+}
+
+func reverseBytes(s string) string {
+	reversed := make([]byte, len(s))
+	for i := 0; i < len(s); i++ {
+		reversed[len(s)-1-i] = s[i]
+	}
+	return string(reversed)
+}
+
+var errNoMatrix = errors.New("Substitution matrix is not set")
+
+// Encodes the sequences with the engine matrix. Seq of the returned
+// *ResidueError is the number of the sequence in the arguments, starting from 1
+func (engine *AlignEngine) encode(seqs ...string) ([]encodedSeq, error) {
+	if engine.Matrix == nil {
+		return nil, errNoMatrix
+	}
+	encoded := make([]encodedSeq, len(seqs))
+	for k, seq := range seqs {
+		enc, err := engine.Matrix.Encode(seq)
+		if err != nil {
+			if residueErr, ok := err.(*ResidueError); ok {
+				residueErr.Seq = k + 1
+			}
+			return nil, err
+		}
+		encoded[k] = encodedSeq{seq, enc}
+	}
+	return encoded, nil
+}
@@ -0,0 +1,78 @@
+package algorithm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Reads the substitution matrix in NCBI (also used by EMBOSS) text format:
+//
+//	# comments
+//	   A  R  N ...
+//	A  4 -1 -2 ...
+//	R -1  5  0 ...
+//
+// The header row lists the residues, every following row starts with its residue
+// and has a score for each residue of the header. Rows may come in any order,
+// but every residue of the header must have exactly one row
+func LoadMatrix(reader io.Reader) (*SubstitutionMatrix, error) {
+	scanner := bufio.NewScanner(reader)
+	var alphabet string
+	var weights [][]int
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if alphabet == "" {
+			for _, field := range fields {
+				if len(field) != 1 {
+					return nil, fmt.Errorf("Matrix line %d: residue \"%s\" is not a single character", line, field)
+				}
+				alphabet += field
+			}
+			weights = make([][]int, len(alphabet))
+			continue
+		}
+		if len(fields[0]) != 1 {
+			return nil, fmt.Errorf("Matrix line %d: residue \"%s\" is not a single character", line, fields[0])
+		}
+		i := strings.IndexByte(alphabet, fields[0][0])
+		if i == -1 {
+			return nil, fmt.Errorf("Matrix line %d: residue \"%s\" is not in the header", line, fields[0])
+		}
+		if weights[i] != nil {
+			return nil, fmt.Errorf("Matrix line %d: second row for residue \"%s\"", line, fields[0])
+		}
+		if len(fields)-1 != len(alphabet) {
+			return nil, fmt.Errorf("Matrix line %d: %d scores for %d residues", line, len(fields)-1, len(alphabet))
+		}
+		row := make([]int, len(alphabet))
+		for j, field := range fields[1:] {
+			score, err := strconv.Atoi(field)
+			if err != nil {
+				return nil, fmt.Errorf("Matrix line %d: bad score \"%s\"", line, field)
+			}
+			row[j] = score
+		}
+		weights[i] = row
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if alphabet == "" {
+		return nil, fmt.Errorf("Matrix has no header row")
+	}
+	for i, row := range weights {
+		if row == nil {
+			return nil, fmt.Errorf("Matrix has no row for residue \"%c\"", alphabet[i])
+		}
+	}
+	return NewSubstitutionMatrix("", alphabet, weights)
+}
@@ -0,0 +1,135 @@
+package algorithm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Alignment mode of AlignEngine.Align
+type AlignMode int
+
+const (
+	// Needleman-Wunsch, both sequences are aligned end to end
+	Global AlignMode = iota
+	// Smith-Waterman, the best scoring pair of substrings
+	Local
+	// Glocal, seq2 (read) is aligned end to end against any part
+	// of seq1 (reference): end gaps are free on the reference only
+	SemiGlobal
+	// Suffix-prefix overlap as in assembly: end gaps are free on both sequences,
+	// so the alignment may also find one sequence contained in the other
+	Overlap
+)
+
+var alignModeNames = map[AlignMode]string{
+	Global:     "global",
+	Local:      "local",
+	SemiGlobal: "semi-global",
+	Overlap:    "overlap",
+}
+
+func (mode AlignMode) String() string {
+	if name, ok := alignModeNames[mode]; ok {
+		return name
+	}
+	return fmt.Sprintf("AlignMode(%d)", int(mode))
+}
+
+// Mode by name, case insensitive. "glocal" is accepted for SemiGlobal
+func ParseAlignMode(name string) (AlignMode, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	name = strings.Replace(name, "-", "", -1)
+	switch name {
+	case "global":
+		return Global, nil
+	case "local":
+		return Local, nil
+	case "semiglobal", "glocal":
+		return SemiGlobal, nil
+	case "overlap":
+		return Overlap, nil
+	}
+	return Global, fmt.Errorf("Unknown alignment mode \"%s\"", name)
+}
+
+// Strand of the nucleotide library sequences searched by FastaSearch
+type Strand int
+
+const (
+	Plus  Strand = iota // The sequences as they are
+	Minus               // Their reverse complements
+	Both                // The better of the two strands for every sequence
+)
+
+var strandNames = map[Strand]string{
+	Plus:  "plus",
+	Minus: "minus",
+	Both:  "both",
+}
+
+func (strand Strand) String() string {
+	if name, ok := strandNames[strand]; ok {
+		return name
+	}
+	return fmt.Sprintf("Strand(%d)", int(strand))
+}
+
+// Strand by name, case insensitive. "+" and "-" are accepted for Plus and Minus
+func ParseStrand(name string) (Strand, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "plus", "+", "forward":
+		return Plus, nil
+	case "minus", "-", "reverse":
+		return Minus, nil
+	case "both":
+		return Both, nil
+	}
+	return Plus, fmt.Errorf("Unknown strand \"%s\", use plus, minus or both", name)
+}
+
+// End gaps that are not penalised. Leading1 means that residues of seq1
+// before the aligned part are free (they would face gaps in Row2), Trailing1 -
+// residues of seq1 after it, the same for seq2. Free end gaps are not included
+// in the alignment rows, Start and End coordinates show the aligned part
+type EndGaps struct {
+	Leading1, Trailing1 bool
+	Leading2, Trailing2 bool
+}
+
+// End gaps the mode does not penalise. Local alignment has no end gaps at all
+func (mode AlignMode) FreeEnds() EndGaps {
+	switch mode {
+	case SemiGlobal:
+		return EndGaps{Leading1: true, Trailing1: true}
+	case Overlap:
+		return EndGaps{Leading1: true, Trailing1: true, Leading2: true, Trailing2: true}
+	}
+	return EndGaps{}
+}
+
+func (ends EndGaps) swapped() EndGaps {
+	return EndGaps{
+		Leading1:  ends.Leading2,
+		Trailing1: ends.Trailing2,
+		Leading2:  ends.Leading1,
+		Trailing2: ends.Trailing1,
+	}
+}
+
+// Aligns the sequences in the engine Mode. EndGaps of the engine,
+// when set, replace the free end gaps of the mode
+func (engine *AlignEngine) Align(seq1 string, seq2 string) (Alignment, error) {
+	seqs, err := engine.encode(seq1, seq2)
+	if err != nil {
+		return Alignment{}, err
+	}
+	return engine.alignEncoded(seqs[0], seqs[1], engine.Mode == Local, engine.freeEnds())
+}
+
+// Free end gaps of the engine Mode, or EndGaps if they are set
+func (engine *AlignEngine) freeEnds() EndGaps {
+	if engine.EndGaps != nil {
+		return *engine.EndGaps
+	}
+	return engine.Mode.FreeEnds()
+}
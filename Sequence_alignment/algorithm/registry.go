@@ -0,0 +1,164 @@
+package algorithm
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NCBI matrix files built into the binary, file name is the matrix name
+//
+//go:embed matrices
+var matrixFiles embed.FS
+
+// Substitution matrix with the gap costs recommended for it.
+// Gap costs follow the engine convention: a gap of length k scores
+// GapOpen + (k-1)*GapExtend, so NCBI "existence 11, extension 1" is GapOpen -12, GapExtend -1
+type MatrixPreset struct {
+	Matrix    *SubstitutionMatrix
+	GapOpen   int
+	GapExtend int
+}
+
+// Registered presets by lower case name, aliases included
+var matrixRegistry = make(map[string]MatrixPreset)
+
+// Canonical names of the registered presets
+var matrixNames []string
+
+func init() {
+	RegisterMatrix(MatrixPreset{MatrixFromFunc("DEFAULT", ScoreDefault), -2, -2})
+	RegisterMatrix(MatrixPreset{BLOSUM62, -12, -1})
+	RegisterMatrix(MatrixPreset{DNAFull, -10, -1}, "NUC.4.4")
+	RegisterMatrix(MatrixPreset{NewTransitionMatrix("TSTV.1.1.2", 1, -1, -2), -3, -1})
+	RegisterMatrix(MatrixPreset{NewTransitionMatrix("TSTV.5.1.4", 5, -1, -4), -10, -1})
+
+	entries, err := matrixFiles.ReadDir("matrices")
+	if err != nil {
+		panic(err)
+	}
+	for _, entry := range entries {
+		if _, ok := builtinGaps[entry.Name()]; !ok {
+			panic(fmt.Errorf("Built-in matrix %s has no gap costs", entry.Name()))
+		}
+	}
+	for name, gap := range builtinGaps {
+		file, err := matrixFiles.Open("matrices/" + name)
+		if err != nil {
+			panic(fmt.Errorf("Built-in matrix %s: %v", name, err))
+		}
+		registerMatrixFile(name, file, gap)
+	}
+	// NCBI BLAST finds its matrix files in the directory of BLASTMAT
+	if dir := os.Getenv("BLASTMAT"); dir != "" {
+		for name, gap := range blastmatGaps {
+			file, err := os.Open(filepath.Join(dir, name))
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			} else if err != nil {
+				panic(err)
+			}
+			registerMatrixFile(name, file, gap)
+		}
+	}
+}
+
+// NCBI gap costs of the matrix files built into the binary, every one must be in matrices
+var builtinGaps = map[string][2]int{
+	"BLOSUM45": {-17, -2},
+	"BLOSUM50": {-15, -2},
+	"BLOSUM80": {-11, -1},
+	"BLOSUM90": {-11, -1},
+	"PAM30":    {-10, -1},
+	"PAM70":    {-11, -1},
+	"PAM250":   {-16, -2},
+}
+
+// Gap costs of the BLOSUM matrices that are not built in, registered when
+// their NCBI file is in BLASTMAT. They take the costs of the nearest
+// BLAST matrix: 45 below it, 50 for 55, 62 for 60 and 65, 80 for 70 and 75, 90 above
+var blastmatGaps = map[string][2]int{
+	"BLOSUM30":  {-17, -2},
+	"BLOSUM35":  {-17, -2},
+	"BLOSUM40":  {-17, -2},
+	"BLOSUM55":  {-15, -2},
+	"BLOSUM60":  {-12, -1},
+	"BLOSUM65":  {-12, -1},
+	"BLOSUM70":  {-11, -1},
+	"BLOSUM75":  {-11, -1},
+	"BLOSUM85":  {-11, -1},
+	"BLOSUM100": {-11, -1},
+}
+
+// Registers the NCBI matrix file under the name with the gap costs, a bad file is fatal
+func registerMatrixFile(name string, file io.ReadCloser, gap [2]int) {
+	matrix, err := LoadMatrix(file)
+	_ = file.Close()
+	if err != nil {
+		panic(fmt.Errorf("Matrix %s: %v", name, err))
+	}
+	matrix.Name = name
+	RegisterMatrix(MatrixPreset{matrix, gap[0], gap[1]})
+}
+
+// Makes the preset available by its matrix name and the aliases, case insensitive.
+// Registering the same name again replaces the preset
+func RegisterMatrix(preset MatrixPreset, aliases ...string) {
+	key := strings.ToLower(preset.Matrix.Name)
+	if _, ok := matrixRegistry[key]; !ok {
+		matrixNames = append(matrixNames, preset.Matrix.Name)
+		sort.Strings(matrixNames)
+	}
+	matrixRegistry[key] = preset
+	for _, alias := range aliases {
+		matrixRegistry[strings.ToLower(alias)] = preset
+	}
+}
+
+// Preset registered under the name or alias, case insensitive
+func LookupMatrix(name string) (MatrixPreset, bool) {
+	preset, ok := matrixRegistry[strings.ToLower(strings.TrimSpace(name))]
+	return preset, ok
+}
+
+// Sorted names of the registered matrices, aliases are not listed
+func MatrixNames() []string {
+	names := make([]string, len(matrixNames))
+	copy(names, matrixNames)
+	return names
+}
+
+// Nucleotide matrix telling transitions (purine to purine, pyrimidine to pyrimidine)
+// from transversions. U is scored as T
+func NewTransitionMatrix(name string, match int, transition int, transversion int) *SubstitutionMatrix {
+	const alphabet = "ACGTU"
+	isPurine := func(c byte) bool { return c == 'A' || c == 'G' }
+	unify := func(c byte) byte {
+		if c == 'U' {
+			return 'T'
+		}
+		return c
+	}
+	weights := make([][]int, len(alphabet))
+	for i := range weights {
+		weights[i] = make([]int, len(alphabet))
+		for j := range weights[i] {
+			a, b := unify(alphabet[i]), unify(alphabet[j])
+			switch {
+			case a == b:
+				weights[i][j] = match
+			case isPurine(a) == isPurine(b):
+				weights[i][j] = transition
+			default:
+				weights[i][j] = transversion
+			}
+		}
+	}
+	return mustMatrix(NewSubstitutionMatrix(name, alphabet, weights))
+}
@@ -0,0 +1,32 @@
+package algorithm
+
+import "strings"
+
+// Record of a sequence file: the header split into the identifier
+// (its first word) and the description, the residues and their qualities
+type Sequence struct {
+	ID          string
+	Description string
+	Residues    string
+	Quality     string // Phred+33 qualities of a FASTQ record, empty for FASTA
+}
+
+// Builds the sequence from the header line without the leading '>' or '@'
+func NewSequence(header string, residues string) Sequence {
+	header = strings.TrimSpace(header)
+	seq := Sequence{Residues: residues}
+	if cut := strings.IndexAny(header, " \t"); cut != -1 {
+		seq.ID, seq.Description = header[:cut], strings.TrimSpace(header[cut+1:])
+	} else {
+		seq.ID = header
+	}
+	return seq
+}
+
+// The header line without the leading '>'
+func (seq Sequence) Header() string {
+	if seq.Description == "" {
+		return seq.ID
+	}
+	return seq.ID + " " + seq.Description
+}
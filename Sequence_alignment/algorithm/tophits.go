@@ -0,0 +1,73 @@
+package algorithm
+
+import (
+	"container/heap"
+	"sort"
+)
+
+// The best hits seen so far, at most Max of them. Kept as a min-heap on Opt,
+// so adding a hit costs O(log Max) and the search keeps O(Max) alignments
+// whatever the library size. Among equal scores the lower Index ranks higher
+type TopHits struct {
+	Max  int
+	hits hitHeap
+}
+
+func NewTopHits(max int) *TopHits {
+	return &TopHits{Max: max}
+}
+
+// Whether hit a ranks above hit b
+func betterHit(a FastaHit, b FastaHit) bool {
+	if a.Opt != b.Opt {
+		return a.Opt > b.Opt
+	}
+	return a.Index < b.Index
+}
+
+// Min-heap with the worst hit on top
+type hitHeap []FastaHit
+
+func (h hitHeap) Len() int            { return len(h) }
+func (h hitHeap) Less(a, b int) bool  { return betterHit(h[b], h[a]) }
+func (h hitHeap) Swap(a, b int)       { h[a], h[b] = h[b], h[a] }
+func (h *hitHeap) Push(x interface{}) { *h = append(*h, x.(FastaHit)) }
+func (h *hitHeap) Pop() interface{} {
+	old := *h
+	hit := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return hit
+}
+
+// Keeps the hit if it is among the best Max ones
+func (top *TopHits) Add(hit FastaHit) {
+	if top.Max <= 0 {
+		return
+	}
+	if len(top.hits) < top.Max {
+		heap.Push(&top.hits, hit)
+	} else if betterHit(hit, top.hits[0]) {
+		top.hits[0] = hit
+		heap.Fix(&top.hits, 0)
+	}
+}
+
+// Adds the hits of the other heap, used to reduce the results of parallel workers
+func (top *TopHits) Merge(other *TopHits) {
+	for _, hit := range other.hits {
+		top.Add(hit)
+	}
+}
+
+func (top *TopHits) Len() int {
+	return len(top.hits)
+}
+
+// Hits from the best to the worst
+func (top *TopHits) Sorted() []FastaHit {
+	sorted := append([]FastaHit(nil), top.hits...)
+	sort.Slice(sorted, func(a, b int) bool {
+		return betterHit(sorted[a], sorted[b])
+	})
+	return sorted
+}
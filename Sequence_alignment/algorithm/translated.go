@@ -0,0 +1,146 @@
+package algorithm
+
+// Translated FASTA search, the sequences of one side are nucleotides
+// compared in their reading frames with a protein matrix such as BLOSUM62
+type TranslatedMode int
+
+const (
+	// tfastx: a protein template against the frame translations of a nucleotide library
+	ProteinVsDNA TranslatedMode = iota
+	// fastx: the frame translations of a nucleotide template against a protein library
+	DNAVsProtein
+)
+
+// Translated FASTA search with the reading frames of params.Strand.
+// Errors of particular sequences are set in Err of their hits as FastaSearch does. Every hit
+// is the best frame of its library sequence: Frame is set, Strand is Minus on
+// the negative frames, the alignment is of the protein sequences,
+// NucleotideStart and NucleotideEnd map it back to the forward strand of the nucleotide side
+func (engine *AlignEngine) TranslatedSearch(template string, seqs []Sequence, mode TranslatedMode,
+	code *GeneticCode, params FastaParams) ([]FastaHit, error) {
+	if len(seqs) == 0 {
+		return nil, ErrNoSequences
+	} else if len(template) == 0 {
+		return nil, ErrEmptyTemplate
+	} else if params.Ktup < 1 || params.Regions < 1 || params.Band < 1 || params.Strand < Plus || params.Strand > Both {
+		return nil, ErrFastaParams
+	}
+	if engine.Matrix == nil {
+		return nil, errNoMatrix
+	}
+	// The frames of the template are indexed once, the library frames are translated per sequence
+	templates := []string{template}
+	templateFrames := []int{0}
+	if mode == DNAVsProtein {
+		templates, templateFrames = nil, params.Strand.Frames()
+		for _, frame := range templateFrames {
+			templates = append(templates, code.Translate(template, frame))
+		}
+	}
+	indices := make([]*KmerIndex, len(templates))
+	for k, translation := range templates {
+		var err error
+		if indices[k], err = NewKmerIndex(engine.Matrix, translation, params.Ktup); err != nil {
+			return nil, err
+		}
+	}
+
+	hits := make([]FastaHit, len(seqs))
+	for i, seq := range seqs {
+		if len(seq.Residues) == 0 {
+			hits[i] = FastaHit{Index: i, ID: seq.ID, Description: seq.Description,
+				Err: &RecordError{Index: i, ID: seq.ID, Err: ErrEmptySequence}}
+			continue
+		}
+		libraryFrames := []int{0}
+		if mode == ProteinVsDNA {
+			libraryFrames = params.Strand.Frames()
+		}
+		if err := engine.canceled(i); err != nil {
+			return nil, err
+		}
+		best := FastaHit{Opt: -1}
+	frames:
+		for k, index := range indices {
+			for _, frame := range libraryFrames {
+				residues := seq.Residues
+				if frame != 0 {
+					residues = code.Translate(residues, frame)
+				}
+				hit, err := engine.translatedHit(index, residues, params)
+				if ctxErr := engine.contextErr(); ctxErr != nil {
+					return nil, ctxErr
+				} else if err != nil {
+					best = FastaHit{Err: &RecordError{Index: i, ID: seq.ID, Err: err}}
+					break frames
+				}
+				// One of the sides is untranslated, its frame is 0
+				if hit.Opt > best.Opt {
+					best, best.Frame = hit, frame+templateFrames[k]
+				}
+			}
+		}
+		// Stats and reports take the length of the library sequence as it is
+		best.Index, best.ID, best.Description, best.Length = i, seq.ID, seq.Description, len(seq.Residues)
+		alignment := best.Alignment
+		if best.Err != nil {
+			best.Length = 0
+		} else if alignment.Length() == 0 {
+			best.Frame = 0
+		} else if mode == ProteinVsDNA {
+			best.NucleotideStart, best.NucleotideEnd = FrameToNucleotide(best.Frame, alignment.Start2, alignment.End2, len(seq.Residues))
+		} else {
+			best.NucleotideStart, best.NucleotideEnd = FrameToNucleotide(best.Frame, alignment.Start1, alignment.End1, len(template))
+		}
+		if best.Frame < 0 {
+			best.Strand = Minus
+		}
+		hits[i] = best
+	}
+	queryLength := len(template)
+	if mode == DNAVsProtein {
+		queryLength /= 3
+	}
+	if !params.SkipStats {
+		SetFastaStats(hits, queryLength)
+	}
+	return hits, nil
+}
+
+// FASTA stages for the translation, empty translations of short sequences score 0
+func (engine *AlignEngine) translatedHit(index *KmerIndex, residues string, params FastaParams) (FastaHit, error) {
+	if len(residues) == 0 || len(index.template.enc) == 0 {
+		return FastaHit{}, nil
+	}
+	encoded, err := engine.encode("", residues)
+	if err != nil {
+		return FastaHit{}, err
+	}
+	return engine.fastaHit(index, encoded[1], params)
+}
+
+// The best translated alignment of the template against the sequences
+// and the index of its sequence, see MultiAlignSequences
+func (engine *AlignEngine) MultiAlignTranslated(template string, seqs []string, mode TranslatedMode,
+	code *GeneticCode) (Alignment, int, error) {
+	records := make([]Sequence, len(seqs))
+	for i, seq := range seqs {
+		records[i].Residues = seq
+	}
+	params := DefaultFastaParams()
+	params.Strand = Both
+	hits, err := engine.TranslatedSearch(template, records, mode, code, params)
+	if err != nil {
+		return Alignment{}, 0, err
+	}
+	best := 0
+	for i := range hits {
+		if hits[i].Err != nil {
+			return Alignment{}, 0, hits[i].Err
+		}
+		if hits[i].Opt > hits[best].Opt {
+			best = i
+		}
+	}
+	return hits[best].Alignment, best, nil
+}
@@ -0,0 +1,133 @@
+package algorithm
+
+import "Bioinformatics/Sequence_alignment/utils"
+
+// Rows of the Gotoh matrices visited by the X-drop extension.
+// Row j keeps the cells lo <= i < lo+len(m), the others were pruned or never reached
+type xDropTables struct {
+	rows []xDropRow
+}
+
+type xDropRow struct {
+	lo      int
+	m, x, y []int
+}
+
+func (t xDropTables) cell(j int, i int) (int, int, int) {
+	if j >= len(t.rows) {
+		return negInf, negInf, negInf
+	}
+	row := t.rows[j]
+	k := i - row.lo
+	if k < 0 || k >= len(row.m) {
+		return negInf, negInf, negInf
+	}
+	return row.m[k], row.x[k], row.y[k]
+}
+
+// Gapped extension of the seed at seq1[pos1], seq2[pos2] in the style of BLAST.
+// The alignment is extended to the right starting with the seed residues
+// and to the left starting with the residues before them. Each direction stops
+// when the score of every cell of a row falls more than xDrop below the best one,
+// so the work is proportional to the length of the hit, not to the sequences
+func (engine *AlignEngine) ExtendSeed(seq1 string, seq2 string, pos1 int, pos2 int, xDrop int) (Alignment, error) {
+	if pos1 < 0 || pos1 > len(seq1) || pos2 < 0 || pos2 > len(seq2) {
+		return Alignment{}, ErrBadSeed
+	}
+	seqs, err := engine.encode(seq1, seq2)
+	if err != nil {
+		return Alignment{}, err
+	}
+	return engine.extendSeed(seqs[0], seqs[1], pos1, pos2, xDrop)
+}
+
+func (engine *AlignEngine) extendSeed(seq1 encodedSeq, seq2 encodedSeq, pos1 int, pos2 int, xDrop int) (Alignment, error) {
+	left, err := engine.xDropExtend(seq1.slice(0, pos1).reversed(), seq2.slice(0, pos2).reversed(), xDrop)
+	if err != nil {
+		return Alignment{}, err
+	}
+	right, err := engine.xDropExtend(seq1.slice(pos1, len(seq1.enc)), seq2.slice(pos2, len(seq2.enc)), xDrop)
+	if err != nil {
+		return Alignment{}, err
+	}
+	row1 := utils.ReverseStr(left.Row1) + right.Row1
+	row2 := utils.ReverseStr(left.Row2) + right.Row2
+	// Gaps of both halves may meet at the seed, so the sum of the scores may count two openings
+	score, err := engine.scoreRows(row1, row2)
+	if err != nil {
+		return Alignment{}, err
+	}
+	return engine.newAlignment(row1, row2, pos1-left.End1, pos2-left.End2, score)
+}
+
+// X-drop extension of the global alignment starting at the beginning of both sequences,
+// ending in its best scoring cell
+func (engine *AlignEngine) xDropExtend(seq1 encodedSeq, seq2 encodedSeq, xDrop int) (Alignment, error) {
+	width := len(seq1.enc) + 1
+	height := len(seq2.enc) + 1
+	var t xDropTables
+	best, iBest, jBest := 0, 0, 0
+	// Range of live cells of the previous row
+	lo, hi := 0, 0
+	for j := 0; j < height; j++ {
+		if err := engine.canceled(j); err != nil {
+			return Alignment{}, err
+		}
+		row := xDropRow{lo: lo}
+		for i := lo; i < width; i++ {
+			m, x, y := negInf, negInf, negInf
+			if i == 0 && j == 0 {
+				m = 0
+			}
+			if i > 0 && j > 0 {
+				prev, _ := utils.Max(t.cell(j-1, i-1))
+				m = prev + engine.Matrix.pair(seq1.enc[i-1], seq2.enc[j-1])
+			}
+			if i > lo {
+				k := i - 1 - row.lo
+				x, _ = utils.Max(row.m[k]+engine.GapOpen, row.x[k]+engine.GapExtend, row.y[k]+engine.GapOpen)
+			}
+			if j > 0 {
+				upM, upX, upY := t.cell(j-1, i)
+				y, _ = utils.Max(upM+engine.GapOpen, upX+engine.GapOpen, upY+engine.GapExtend)
+			}
+			score, _ := utils.Max(m, x, y)
+			if score < best-xDrop {
+				m, x, y = negInf, negInf, negInf
+				if i > hi {
+					// Nothing beyond the previous row range can be reached but through this cell
+					break
+				}
+			} else if score > best {
+				best, iBest, jBest = score, i, j
+			}
+			row.m = append(row.m, m)
+			row.x = append(row.x, x)
+			row.y = append(row.y, y)
+		}
+		row = trimXDropRow(row)
+		if len(row.m) == 0 {
+			break
+		}
+		t.rows = append(t.rows, row)
+		lo, hi = row.lo, row.lo+len(row.m)
+	}
+	return engine.findAlign(seq1, seq2, t, false, EndGaps{}, iBest, jBest)
+}
+
+// Cuts the pruned cells from both ends of the row
+func trimXDropRow(row xDropRow) xDropRow {
+	from, to := 0, len(row.m)
+	for from < to && row.m[from] == negInf && row.x[from] == negInf && row.y[from] == negInf {
+		from++
+	}
+	for to > from && row.m[to-1] == negInf && row.x[to-1] == negInf && row.y[to-1] == negInf {
+		to--
+	}
+	return xDropRow{
+		lo: row.lo + from,
+		m:  row.m[from:to],
+		x:  row.x[from:to],
+		y:  row.y[from:to],
+	}
+}
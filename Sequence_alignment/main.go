@@ -2,99 +2,227 @@ package main
 
 import (
 	. "Bioinformatics/Sequence_alignment/algorithm"
+	"Bioinformatics/Sequence_alignment/seqio"
 	. "Bioinformatics/Sequence_alignment/utils"
-	"bufio"
+	"context"
 	"flag"
 	"fmt"
 	"github.com/pkg/errors"
 	"io"
-	"log"
-	"math"
 	"os"
-	"strconv"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 )
 
-func readTemplate(path string) string {
-	file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
-	defer func() {
-		err := file.Close()
-		if err != nil {
-			log.Fatal(err)
-		}
-	}()
+// Records of a sequence file or of a region of an indexed FASTA file
+type recordReader interface {
+	Next() bool
+	Sequence() Sequence
+	Err() error
+}
 
-	check(err)
-	reader := bufio.NewReader(file)
+// The record of a region, read ahead by the index
+type regionRecords struct {
+	seqs []Sequence
+	seq  Sequence
+}
 
-	seq1, err := reader.ReadString('\n')
-	if err != io.EOF {
-		check(err)
+func (r *regionRecords) Next() bool {
+	if len(r.seqs) == 0 {
+		return false
 	}
+	r.seq, r.seqs = r.seqs[0], r.seqs[1:]
+	return true
+}
 
-	return strings.TrimSpace(seq1)
+func (r *regionRecords) Sequence() Sequence {
+	return r.seq
 }
 
-func readFile(path string) (string, string) {
-	file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
-	defer func() {
-		err := file.Close()
+func (r *regionRecords) Err() error {
+	return nil
+}
+
+// Splits the input into the file and the region of its record, e.g. ref.fa:chr1:100-200.
+// An input naming an existing file has no region
+func splitRegion(input string) (string, string) {
+	if _, err := os.Stat(input); err == nil {
+		return input, ""
+	}
+	for i := range input {
+		if input[i] != ':' {
+			continue
+		}
+		if info, err := os.Stat(input[:i]); err == nil && !info.IsDir() {
+			return input[:i], input[i+1:]
+		}
+	}
+	return input, ""
+}
+
+// Opens the records of the input: every record of a FASTA, FASTQ or plain file,
+// possibly gzip-compressed, or the region of a FASTA file read with its .fai index
+func openRecords(input string) (recordReader, io.Closer, error) {
+	path, region := splitRegion(input)
+	if region == "" {
+		file, err := os.Open(path)
 		if err != nil {
-			log.Fatal(err)
+			return nil, nil, err
 		}
-	}()
+		return seqio.NewReader(file), file, nil
+	}
+	fasta, file, err := seqio.OpenIndexedFasta(path)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, path)
+	}
+	seq, err := fasta.Fetch(region)
+	if err != nil {
+		file.Close()
+		return nil, nil, errors.Wrap(err, path)
+	}
+	return &regionRecords{seqs: []Sequence{seq}}, file, nil
+}
 
-	check(err)
-	reader := bufio.NewReader(file)
+// Reads the first count records of the input
+func readSequences(path string, count int) ([]Sequence, error) {
+	reader, file, err := openRecords(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var seqs []Sequence
+	for len(seqs) < count && reader.Next() {
+		seqs = append(seqs, reader.Sequence())
+	}
+	if err := reader.Err(); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	if len(seqs) < count {
+		return nil, errors.Errorf("%s: %d sequences expected, found %d", path, count, len(seqs))
+	}
+	return seqs, nil
+}
 
-	seq1, err := reader.ReadString('\n')
-	check(err)
-	seq2, err := reader.ReadString('\n')
-	if err != io.EOF {
-		check(err)
+// Reads the template: the first record of the file
+func readTemplate(path string) (Sequence, error) {
+	seqs, err := readSequences(path, 1)
+	if err != nil {
+		return Sequence{}, err
 	}
+	return seqs[0], nil
+}
 
-	return strings.TrimSpace(seq1), strings.TrimSpace(seq2)
+// Reads the pair of sequences to align: the first two records of the file
+func readFile(path string) (Sequence, Sequence, error) {
+	seqs, err := readSequences(path, 2)
+	if err != nil {
+		return Sequence{}, Sequence{}, err
+	}
+	return seqs[0], seqs[1], nil
 }
 
-func writeSeqToFile(path string, seq1 string, seq2 string, score int) {
+// Writes the alignment to the file, gzip-compressed if the path ends with .gz
+func writeSeqToFile(path string, alignment Alignment) (err error) {
 	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
 	defer func() {
-		err := file.Close()
-		if err != nil {
-			log.Fatal(err)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
 		}
 	}()
-	check(err)
-	_, err = file.WriteString(seq1)
-	check(err)
-	_, err = file.WriteString("\n")
-	check(err)
-	_, err = file.WriteString(seq2)
-	check(err)
-	_, err = file.WriteString("\n")
-	check(err)
-	_, err = file.WriteString(strconv.Itoa(score))
-	check(err)
-}
-
-func getScoreFuncAndPenalty(funcType string) (ScoreFuncType, int, error) {
-	funcType = strings.ToLower(strings.TrimSpace(funcType))
-	switch funcType {
-	case "default":
-		return ScoreDefault, -2, nil
-	case "blosum62":
-		return ScoreBLOSUM62, -4, nil
-	case "dnafull":
-		return ScoreDNAFull, -4, nil
-	default:
-		return nil, -2, errors.New("Unknown matrix type")
+	writer := seqio.NewWriter(file, strings.HasSuffix(path, ".gz"))
+	defer func() {
+		if closeErr := writer.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	_, err = fmt.Fprintf(writer, "%s\n%s\n%d", alignment.Row1, alignment.Row2, alignment.Score)
+	return err
+}
+
+// Output paths written as SAM or BAM instead of the aligned rows
+func isSamPath(path string) bool {
+	return strings.HasSuffix(path, ".sam") || strings.HasSuffix(path, ".sam.gz") || strings.HasSuffix(path, ".bam")
+}
+
+// Writes the records as BAM if the path ends with .bam, as SAM otherwise,
+// gzip-compressed if the path ends with .gz
+func writeSamFile(path string, references []seqio.SamReference, records []seqio.SamRecord) (err error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	var writer seqio.RecordWriter
+	if strings.HasSuffix(path, ".bam") {
+		writer, err = seqio.NewBamWriter(file, references)
+	} else {
+		compressed := seqio.NewWriter(file, strings.HasSuffix(path, ".gz"))
+		defer func() {
+			if closeErr := compressed.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		writer, err = seqio.NewSamWriter(compressed, references)
+	}
+	for _, record := range records {
+		if err != nil {
+			return err
+		}
+		err = writer.Write(record)
+	}
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// Identifier of the record for SAM, which allows no empty names
+func samName(seq Sequence, fallback string) string {
+	if seq.ID != "" {
+		return seq.ID
+	}
+	return fallback
+}
+
+// Reads the substitution matrix from the file in NCBI format
+func readMatrix(path string) (*SubstitutionMatrix, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	matrix, err := LoadMatrix(file)
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	matrix.Name = filepath.Base(path)
+	return matrix, nil
+}
+
+func printMatrices() {
+	fmt.Printf("%-12s %8s %10s\n", "Matrix", "Gap open", "Gap extend")
+	for _, name := range MatrixNames() {
+		preset, _ := LookupMatrix(name)
+		fmt.Printf("%-12s %8d %10d\n", name, preset.GapOpen, preset.GapExtend)
 	}
 }
 
-func check(err error) {
+// Reports the error and stops the program, for the errors main can not recover from
+func exitOnError(err error) {
 	if err != nil {
-		panic(err)
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 }
 
@@ -108,212 +236,592 @@ func isFlagPassed(name string) bool {
 	return found
 }
 
-func readFastaFilePart(reader *bufio.Reader, maxSize int) ([]string, bool) {
-	arr := make([]string, maxSize)
-	i := 0
-	var sb strings.Builder
-	var str string
-	var err error
-	for err == nil && i < maxSize {
-		str, err = reader.ReadString('\n')
-		str = strings.TrimSpace(str)
-		prefix := strings.HasPrefix(str, ">")
-		if prefix && sb.Len() > 0 {
-			arr[i] = sb.String()
-			i++
-			sb.Reset()
-		} else if !prefix {
-			sb.WriteString(str)
+// Reads at most maxSize records of the sequence file, true at its end
+func readFastaFilePart(reader recordReader, maxSize int) ([]Sequence, bool, error) {
+	var records []Sequence
+	for len(records) < maxSize {
+		if !reader.Next() {
+			return records, true, reader.Err()
 		}
+		records = append(records, reader.Sequence())
 	}
-	if sb.Len() > 0 {
-		arr[i] = sb.String()
-		i++
+	return records, false, nil
+}
+
+// Scores a part of the library against the template
+type searchFunc func(ctx context.Context, sequences []Sequence) ([]FastaHit, error)
+
+// FASTA search with the template words indexed once for the whole library
+func fastaSearcher(template Sequence, engine AlignEngine, params FastaParams) (searchFunc, error) {
+	if params.Strand != Plus && !engine.Matrix.IsNucleotide() {
+		return nil, ErrStrandProtein
 	}
-	return arr[:i], err == io.EOF
+	index, err := NewKmerIndex(engine.Matrix, template.Residues, params.Ktup)
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, sequences []Sequence) ([]FastaHit, error) {
+		return engine.FastaSearchIndexContext(ctx, index, sequences, params)
+	}, nil
 }
 
-func goFastaCompute(template string, sequences []string, engine AlignEngine) DataChunk {
-	const PART_SIZE = 1_000
-	if len(sequences) < PART_SIZE {
-		if len(sequences) == 0 {
-			return DataChunk{template, "", math.MinInt64}
-		}
-		_, _, score, index := engine.MultiAlignSequences(template, sequences)
-		return DataChunk{
-			str1:  template,
-			str2:  sequences[index],
-			score: score,
-		}
+// Translated FASTA search, see TranslatedSearch
+func translatedSearcher(template Sequence, engine AlignEngine, params FastaParams,
+	mode TranslatedMode, code *GeneticCode) searchFunc {
+	return func(ctx context.Context, sequences []Sequence) ([]FastaHit, error) {
+		return engine.TranslatedSearchContext(ctx, template.Residues, sequences, mode, code, params)
 	}
-	workers := 0
-	ch := make(chan DataChunk)
-	i := 0
-	j := i + PART_SIZE
-	for i < len(sequences) {
-		if j >= len(sequences) {
-			j = len(sequences) - 1
-		}
-		workers++
-		scope := sequences[i:j]
-
-		go func(template string, scope []string) {
-			if len(scope) > 0 {
-				_, _, score, index := engine.MultiAlignSequences(template, scope)
-				ch <- DataChunk{
-					str1:  template,
-					str2:  scope[index],
-					score: score,
-				}
-			} else {
-				ch <- DataChunk{"", "", math.MinInt64}
-			}
-		}(template, scope)
-		if i == j {
-			break
+}
+
+// FASTA scores of the template against the sequences. Sequences that can not be aligned
+// are reported to stderr and skipped, so one bad record does not stop the search.
+// Hit indices are moved by offset to count records from the start of the file
+func alignBest(ctx context.Context, search searchFunc, sequences []Sequence, offset int, maxHits int) DataChunk {
+	top := NewTopHits(maxHits)
+	if len(sequences) == 0 {
+		return DataChunk{offset: offset, top: top}
+	}
+	hits, err := search(ctx, sequences)
+	if err != nil {
+		return DataChunk{err: err}
+	}
+	scores := make([]HitScore, 0, len(hits))
+	for _, hit := range hits {
+		var recordErr *RecordError
+		if errors.As(hit.Err, &recordErr) {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping sequence %s: %v\n", recordName(sequences[hit.Index], offset+hit.Index), recordErr.Err)
+			continue
 		}
-		i = j
-		j = i + PART_SIZE
+		hit.Index += offset
+		top.Add(hit)
+		scores = append(scores, hit.Score())
 	}
+	return DataChunk{offset: offset, scores: scores, top: top}
+}
 
-	var resSequences []string
-	for i := 0; i < workers; i++ {
-		data := <-ch
-		if len(data.str2) > 0 {
-			resSequences = append(resSequences, data.str2)
+// Merges the chunks in the order of the records, whatever order they come in
+func mergeDataChunks(chunks []DataChunk, maxHits int) DataChunk {
+	sort.Slice(chunks, func(a, b int) bool {
+		return chunks[a].offset < chunks[b].offset
+	})
+	res := DataChunk{top: NewTopHits(maxHits)}
+	for _, chunk := range chunks {
+		if chunk.err != nil {
+			return DataChunk{err: chunk.err}
+		}
+		res.scores = append(res.scores, chunk.scores...)
+		if chunk.top != nil {
+			res.top.Merge(chunk.top)
 		}
-		//fmt.Printf("str1:\t%s\nstr2:\t%s\nscore:\t%d\n", data.str1, template, data.score)
 	}
-	return goFastaCompute(template, resSequences, engine)
+	return res
+}
+
+// Library records from offset on, the unit of work of the search workers
+type recordBatch struct {
+	offset    int
+	sequences []Sequence
 }
 
-func goFasta(path string, template string, engine AlignEngine) (string, string, int, int) {
-	file, err := os.OpenFile(path, os.O_RDONLY, os.ModePerm)
+// Searches the records in a pipeline: one goroutine reads batches of records,
+// threads workers score them and the caller collects the chunks. The channels
+// hold at most threads batches and chunks and reading overlaps with the alignment.
+// Besides the best hits only the HitScore of every record is kept for the statistics,
+// so memory grows with the library by 16 bytes a record.
+// The scores of the result are in the order of the records. Once ctx is done
+// no more records are read, the result holds the batches scored so far
+// and the error of ctx
+func searchRecords(ctx context.Context, reader recordReader, search searchFunc, maxHits int, threads int) DataChunk {
+	const BATCH_SIZE = 1_000
+	batches := make(chan recordBatch, threads)
+	chunks := make(chan DataChunk, threads)
+	done := make(chan struct{})
+	var readErr error
+	go func() {
+		defer close(batches)
+		offset := 0
+		for isEOF := false; !isEOF; {
+			var sequences []Sequence
+			sequences, isEOF, readErr = readFastaFilePart(reader, BATCH_SIZE)
+			if readErr != nil || len(sequences) == 0 {
+				return
+			}
+			select {
+			case batches <- recordBatch{offset: offset, sequences: sequences}:
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			offset += len(sequences)
+		}
+	}()
+	var workers sync.WaitGroup
+	for w := 0; w < threads; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for batch := range batches {
+				select {
+				case chunks <- alignBest(ctx, search, batch.sequences, batch.offset, maxHits):
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(chunks)
+	}()
+	// On an early return the reader and the workers stop,
+	// draining the chunks waits for them to leave
 	defer func() {
-		err := file.Close()
-		if err != nil {
-			log.Fatal(err)
+		close(done)
+		for range chunks {
 		}
 	}()
-	check(err)
-	reader := bufio.NewReader(file)
-	isEOF := false
-	var sequences []string
-	const PART_SIZE = 100_000
-	workers := 0
-	var resSequences []string
-	for !isEOF { // So, let's read file by parts and spawn workers for each part
-		sequences, isEOF = readFastaFilePart(reader, PART_SIZE)
-		fmt.Printf("Computation stage %d\n", workers)
-		workers++
-		seqCandidate := goFastaCompute(template, sequences, engine).str2
-		if len(seqCandidate) > 0 {
-			resSequences = append(resSequences, seqCandidate)
+
+	// The best hits are merged as the chunks come, the scores once the order is known
+	top := NewTopHits(maxHits)
+	var scored []DataChunk
+	for chunk := range chunks {
+		// Batches canceled in the middle are dropped, the finished ones are kept
+		if chunk.err != nil && ctx.Err() != nil && errors.Is(chunk.err, ctx.Err()) {
+			continue
+		} else if chunk.err != nil {
+			return chunk
 		}
+		top.Merge(chunk.top)
+		scored = append(scored, DataChunk{offset: chunk.offset, scores: chunk.scores})
+	}
+	// The reader has finished once the workers have
+	if readErr != nil {
+		return DataChunk{err: readErr}
 	}
+	res := mergeDataChunks(scored, maxHits)
+	res.top, res.err = top, ctx.Err()
+	return res
+}
 
-	//fmt.Printf("Spawned %d workers\n", workers)
-	//for i := 0; i < workers; i++ {
-	//	data := <-ch
-	//	resSequences = append(resSequences, data.str2)
-	//	fmt.Printf("str1:\t%s\nstr2:\t%s\nscore:\t%d\n", data.str1, data.str2, data.score)
-	//}
-	fmt.Printf("res seq: %v\n", resSequences)
-	return engine.MultiAlignSequences(template, resSequences)
+// Searches the FASTA file for the sequences most similar to the template
+// with the given number of workers. Returns at most maxHits best hits from the best one,
+// with the statistics estimated over the whole file for the query of the given length, and the number of records.
+// Once ctx is done the hits and the statistics cover the records scored so far,
+// they are returned with the error of ctx
+func goFasta(ctx context.Context, path string, search searchFunc, queryLength int, maxHits int, threads int) ([]FastaHit, int, error) {
+	reader, file, err := openRecords(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	res := searchRecords(ctx, reader, search, maxHits, threads)
+	if res.err != nil && res.err != ctx.Err() {
+		return nil, 0, errors.Wrap(res.err, path)
+	}
+	if res.top.Len() == 0 && res.err != nil {
+		return nil, 0, res.err
+	} else if res.top.Len() == 0 {
+		return nil, 0, ErrNoSequences
+	}
+	stats := FitScoreStats(res.scores, queryLength)
+	hits := res.top.Sorted()
+	for i := range hits {
+		stats.Apply(&hits[i])
+	}
+	return hits, len(res.scores), res.err
 }
 
 type DataChunk struct {
-	str1, str2 string
-	score      int
+	offset int        // Number of the first record of the chunk in the file
+	scores []HitScore // Scores of every aligned record, for the statistics
+	top    *TopHits   // The best hits with alignments
+	err    error
+}
+
+// Header of the record, or its number in the file if it has none
+func recordName(seq Sequence, index int) string {
+	if seq.ID != "" {
+		return seq.Header()
+	}
+	return fmt.Sprintf("record %d", index+1)
+}
+
+// Summary of the hit in the format of fasta36, libraryUnit is "aa" or "nt"
+// for the length of the library sequence and alignUnit for the overlap
+func printFastaHit(hit FastaHit, librarySize int, libraryUnit string, alignUnit string) {
+	alignment := hit.Alignment
+	identity, similarity := 0.0, 0.0
+	if alignment.Length() > 0 {
+		identity = 100 * float64(alignment.Identities) / float64(alignment.Length())
+		similarity = 100 * float64(alignment.Similarities) / float64(alignment.Length())
+	}
+	// Minus strand positions count the library sequence forward, from the alignment end
+	start2, end2 := alignment.Start2+1, alignment.End2
+	strand := ""
+	// Translated hits count the residues of their frame, the nucleotides are on the frame line
+	if hit.Strand == Minus && hit.Frame == 0 {
+		start2, end2 = hit.Length-alignment.Start2, hit.Length-alignment.End2+1
+		strand = " rev-comp"
+	}
+	fmt.Printf(">>%s (%d %s)%s\n", recordName(Sequence{ID: hit.ID, Description: hit.Description}, hit.Index), hit.Length, libraryUnit, strand)
+	if hit.Frame != 0 {
+		fmt.Printf(" frame: %+d, nucleotides %d-%d\n", hit.Frame, hit.NucleotideStart+1, hit.NucleotideEnd)
+	}
+	fmt.Printf(" initn: %d init1: %d opt: %d  Z-score: %.1f  bits: %.1f E(%d): %.2g\n",
+		hit.Initn, hit.Init1, hit.Opt, hit.ZScore, hit.Bits, librarySize, hit.EValue)
+	fmt.Printf("Smith-Waterman score: %d; %.1f%% identity (%.1f%% similar) in %d %s overlap (%d-%d:%d-%d)\n",
+		hit.Opt, identity, similarity, alignment.Length(), alignUnit,
+		alignment.Start1+1, alignment.End1, start2, end2)
+}
+
+// Parses the -translate mode
+func parseTranslatedMode(name string) (TranslatedMode, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "tfastx", "protein-dna":
+		return ProteinVsDNA, nil
+	case "fastx", "dna-protein":
+		return DNAVsProtein, nil
+	}
+	return ProteinVsDNA, errors.New("Unknown translated mode \"" + name + "\", use tfastx or fastx")
+}
+
+// Parses the -free-ends list, e.g. "start1,end1"
+func parseEndGaps(list string) (EndGaps, error) {
+	var ends EndGaps
+	for _, name := range strings.Split(list, ",") {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "start1":
+			ends.Leading1 = true
+		case "end1":
+			ends.Trailing1 = true
+		case "start2":
+			ends.Leading2 = true
+		case "end2":
+			ends.Trailing2 = true
+		case "none", "":
+		default:
+			return EndGaps{}, errors.New("Unknown end \"" + name + "\", use start1, end1, start2, end2")
+		}
+	}
+	return ends, nil
 }
 
 func main() {
 	// Command line arguments
-	gapPtr := flag.Int("g", -2, "gap penalty as int")
+	gapPtr := flag.Int("g", -2,
+		"gap penalty as int, the weight matrix default if not passed")
+	gapExtendPtr := flag.Int("ge", -2,
+		"gap extension penalty as int, the same as gap penalty if only -g is passed")
 	inpPtr := flag.String("i", "",
-		"input file, containing 2 sequences, separated with a newline")
+		"input file, containing 2 sequences as FASTA, FASTQ or one per line, may be gzip-compressed.\n"+
+			"file:region, e.g. ref.fa:chr1:100-200, reads the region of an indexed FASTA file")
 	outpPtr := flag.String("o", "",
-		"output file, write 2 aligned sequences, separated with a newline")
+		"output file, write 2 aligned sequences, separated with a newline, gzip-compressed if it ends with .gz.\n"+
+			"Files ending with .sam, .sam.gz or .bam get SAM or uncompressed BAM with every alignment")
 	typePtr := flag.String("t", "default",
-		"type of the weight matrix. Possible types DNAFull, BLOSUM62, DEFAULT")
+		"type of the weight matrix, see -list-matrices for possible types.\n"+
+			"BLOSUM30-100 not built in are read from the NCBI matrix files in $BLASTMAT")
+	matrixPtr := flag.String("matrix", "",
+		"file with the weight matrix in NCBI format, overrides -t")
+	listMatricesPtr := flag.Bool("list-matrices", false,
+		"print the built-in weight matrices with their default gap penalties and exit")
 	algoPtr := flag.String("algo", "Needleman-Wunsch",
-		"Chose the alignment algorithm (Needleman-Wunsch|Smith-Waterman|Hirschberg|FASTA)")
+		"Chose the alignment algorithm (Needleman-Wunsch|Smith-Waterman|Smith-Waterman-linear|Hirschberg|FASTA|Semi-global|Overlap|Frameshift).\n"+
+			"Frameshift aligns the DNA of seq1 to the protein of seq2 allowing frameshifts")
+	modePtr := flag.String("mode", "",
+		"alignment mode (global|local|semi-global|glocal|overlap), overrides -algo")
+	freeEndsPtr := flag.String("free-ends", "",
+		"comma separated end gaps that are not penalised (start1,end1,start2,end2), overrides the mode")
 	//multiAlignPtr := flag.String("fasta", "",
 	//	"Read file in FASTA format and go FASTA!")
+	bandPtr := flag.Int("band", 0,
+		"banded global or semi-global alignment within the given number of diagonals, 0 for automatic")
+	ktupPtr := flag.Int("ktup", DefaultFastaParams().Ktup,
+		"word length of FASTA search, 1-2 for proteins and 4-6 for nucleotides")
+	strandPtr := flag.String("strand", "plus",
+		"strands of nucleotide library sequences searched by FASTA (plus|minus|both), minus and both need a nucleotide matrix or -translate")
+	translatePtr := flag.String("translate", "",
+		"translated FASTA search: tfastx for a protein template against a nucleotide library, fastx for the other way round")
+	geneticCodePtr := flag.Int("gcode", 1,
+		"NCBI genetic code (transl_table 1-33) of translated search and frameshift alignment")
+	frameshiftPtr := flag.Int("fs", DefaultFrameshiftPenalty,
+		"frameshift penalty of frameshift alignment")
+	threadsPtr := flag.Int("threads", runtime.GOMAXPROCS(0),
+		"number of FASTA search workers")
+	maxHitsPtr := flag.Int("max-hits", 10,
+		"number of the best FASTA hits to report")
+	timeoutPtr := flag.Duration("timeout", 0,
+		"stop the alignment or the search after the given time, e.g. 30s or 5m, 0 for no limit.\n"+
+			"The search prints the hits of the records scored until then, so does an interrupt with Ctrl+C")
 	templatePtr := flag.String("templ", "",
-		"Template for FASTA alignment")
+		"Template for FASTA alignment, or the first sequence to align against the input. Accepts file:region as -i does")
 	flag.Parse()
 
+	if *listMatricesPtr {
+		printMatrices()
+		return
+	}
+
 	algo := strings.TrimSpace(*algoPtr)
 	algo = strings.Replace(algo, "-", "", -1)
 	algo = strings.ToLower(algo)
+	mode := strings.TrimSpace(*modePtr)
+	switch algo {
+	case "semiglobal", "glocal", "overlap":
+		if mode == "" {
+			mode = algo
+		}
+	}
+	if mode != "" || *freeEndsPtr != "" {
+		algo = "align"
+	}
+	if isFlagPassed("band") {
+		algo = "banded"
+	}
+	translated := *translatePtr != ""
+	if translated {
+		algo = "fasta"
+	}
 
 	var (
-		seq1, seq2 string
-		err        error
+		first, second Sequence // The pair to align, the reference and the query of SAM output
+		err           error
 	)
 	inpFile := strings.TrimSpace(*inpPtr)
-	if inpFile != "" && algo != "fasta" {
-		seq1, seq2 = readFile(inpFile)
-		check(err)
+	if inpFile != "" && algo != "fasta" && *templatePtr != "" {
+		// The template against the first record of the input, e.g. a region of the reference
+		first, err = readTemplate(*templatePtr)
+		exitOnError(err)
+		second, err = readTemplate(inpFile)
+		exitOnError(err)
+	} else if inpFile != "" && algo != "fasta" {
+		first, second, err = readFile(inpFile)
+		exitOnError(err)
 	} else if *templatePtr != "" {
 	} else {
 		_, _ = fmt.Fprintf(os.Stderr, "Usage of %s:\n", os.Args[0])
 		flag.PrintDefaults()
 		return
 	}
-	scoreFunc, gapPenalty, err := getScoreFuncAndPenalty(*typePtr)
-	check(err)
+	matrixName := *typePtr
+	if algo == "fasty" {
+		algo = "frameshift"
+	}
+	if (translated || algo == "frameshift") && !isFlagPassed("t") {
+		matrixName = "BLOSUM62"
+	}
+	preset, ok := LookupMatrix(matrixName)
+	if !ok {
+		exitOnError(errors.New("Unknown matrix type, see -list-matrices"))
+	}
+	matrix, gapPenalty, gapExtend := preset.Matrix, preset.GapOpen, preset.GapExtend
+	if matrixFile := strings.TrimSpace(*matrixPtr); matrixFile != "" {
+		matrix, err = readMatrix(matrixFile)
+		exitOnError(err)
+	}
 
 	if isFlagPassed("g") {
 		gapPenalty = *gapPtr
+		gapExtend = gapPenalty
+	}
+	if isFlagPassed("ge") {
+		gapExtend = *gapExtendPtr
 	}
 
 	// Engine setup
-	engine := NewAlignEngine(scoreFunc, gapPenalty)
+	engine := NewMatrixAlignEngine(matrix, gapPenalty, gapExtend)
+	if mode != "" {
+		engine.Mode, err = ParseAlignMode(mode)
+		exitOnError(err)
+	}
+	if *freeEndsPtr != "" {
+		ends, err := parseEndGaps(*freeEndsPtr)
+		exitOnError(err)
+		engine.EndGaps = &ends
+	}
 
-	seq1 = strings.ToUpper(seq1)
-	seq2 = strings.ToUpper(seq2)
+	seq1 := strings.ToUpper(first.Residues)
+	seq2 := strings.ToUpper(second.Residues)
 
-	var (
-		alignedSeq1, alignedSeq2 string
-		score                    int
-	)
+	// Ctrl+C cancels the alignment, a second one kills the program
+	interrupt, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	go func() {
+		<-interrupt.Done()
+		stop()
+	}()
+	ctx := interrupt
+	if *timeoutPtr > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *timeoutPtr)
+		defer cancel()
+	}
+
+	var alignment Alignment
+	var interrupted error             // Set when the search was stopped and its hits are partial
+	var libraryUnit, alignUnit string // "aa" or "nt" of the library sequences and of the search alignments
+	var frameshifts []Frameshift
+	var fastaHits []FastaHit
+	var librarySize int
 
 	switch algo {
 	case "hirschberg":
-		alignedSeq1, alignedSeq2 = engine.Hirschberg(seq1, seq2)
+		alignment, err = engine.HirschbergContext(ctx, seq1, seq2)
 		break
 	case "smithwaterman":
-		alignedSeq1, alignedSeq2, score = engine.SmithWaterman(seq1, seq2)
+		alignment, err = engine.SmithWatermanContext(ctx, seq1, seq2)
+		break
+	case "smithwatermanlinear":
+		alignment, err = engine.SmithWatermanLinearContext(ctx, seq1, seq2)
 		break
 	case "needlemanwunsch":
-		alignedSeq1, alignedSeq2, score = engine.NeedlemanWunsch(seq1, seq2)
+		alignment, err = engine.NeedlemanWunschContext(ctx, seq1, seq2)
+		break
+	case "align":
+		alignment, err = engine.AlignContext(ctx, seq1, seq2)
+		break
+	case "frameshift":
+		var code *GeneticCode
+		if code, err = LookupGeneticCode(*geneticCodePtr); err != nil {
+			break
+		}
+		var result FrameshiftAlignment
+		result, err = engine.AlignFrameshiftContext(ctx, seq1, seq2, code, *frameshiftPtr)
+		alignment, frameshifts = result.Alignment, result.Frameshifts
+		break
+	case "banded":
+		var edge bool
+		alignment, edge, err = engine.AlignBandedContext(ctx, seq1, seq2, *bandPtr)
+		if edge {
+			_, _ = fmt.Fprintln(os.Stderr, "Alignment touches the band edge, a wider -band may give a better score")
+		}
 		break
 	case "fasta":
 		if *templatePtr == "" {
-			panic("Pass FASTA template!")
+			exitOnError(errors.New("Pass FASTA template!"))
 		}
-		template := readTemplate(*templatePtr)
+		first, err = readTemplate(*templatePtr)
+		exitOnError(err)
+		template := first
 		if inpFile == "" {
-			panic("No input file specified!")
+			exitOnError(errors.New("No input file specified!"))
+		}
+		if *maxHitsPtr < 1 {
+			exitOnError(errors.New("-max-hits must be positive"))
+		}
+		if *threadsPtr < 1 {
+			exitOnError(errors.New("-threads must be positive"))
+		}
+		params := DefaultFastaParams()
+		params.Ktup = *ktupPtr
+		// goFasta fits the statistics over the whole library
+		params.SkipStats = true
+		params.Strand, err = ParseStrand(*strandPtr)
+		exitOnError(err)
+		search, queryLength, unit := searchFunc(nil), len(template.Residues), "aa"
+		libraryUnit, alignUnit = "aa", "aa"
+		if translated {
+			// Every reading frame is searched unless the strand is chosen
+			if !isFlagPassed("strand") {
+				params.Strand = Both
+			}
+			mode, err := parseTranslatedMode(*translatePtr)
+			exitOnError(err)
+			code, err := LookupGeneticCode(*geneticCodePtr)
+			exitOnError(err)
+			if mode == DNAVsProtein {
+				queryLength, unit = queryLength/3, "nt"
+			} else {
+				libraryUnit = "nt"
+			}
+			search = translatedSearcher(template, engine, params, mode, code)
+		} else {
+			if matrix.IsNucleotide() {
+				unit, libraryUnit, alignUnit = "nt", "nt", "nt"
+			}
+			search, err = fastaSearcher(template, engine, params)
+			exitOnError(err)
+		}
+		fastaHits, librarySize, err = goFasta(ctx, inpFile, search, queryLength, *maxHitsPtr, *threadsPtr)
+		if fastaHits != nil && err != nil {
+			// The hits of the records scored before the search was stopped
+			interrupted = err
+			err = nil
+		}
+		if err == nil {
+			alignment = fastaHits[0].Alignment
+			name := template.Header()
+			if name == "" {
+				name = "template"
+			}
+			fmt.Printf("1>>>%s - %d %s\n", name, len(template.Residues), unit)
 		}
-		alignedSeq1, alignedSeq2, score, _ = goFasta(inpFile, template, engine)
 		break
 	default:
-		panic("Unknown algorithm! Available options = Needleman-Wunsch | Smith-Waterman | Hirschberg | FASTA")
+		err = errors.New("Unknown algorithm! Available options = Needleman-Wunsch | Smith-Waterman | Smith-Waterman-linear | Hirschberg | FASTA | Semi-global | Overlap | Frameshift")
+	}
+	if ctx.Err() != nil && errors.Is(err, ctx.Err()) {
+		err = errors.Wrap(err, "Alignment stopped")
 	}
-	check(err)
+	exitOnError(err)
 
 	outpFile := strings.TrimSpace(*outpPtr)
-	if outpFile != "" {
-		writeSeqToFile(outpFile, alignedSeq1, alignedSeq2, score)
+	if outpFile != "" && isSamPath(outpFile) && (translated || algo == "frameshift") {
+		exitOnError(errors.New("SAM output of translated alignment is not supported"))
+	} else if outpFile != "" && isSamPath(outpFile) {
+		reference := samName(first, "seq1")
+		var records []seqio.SamRecord
+		if fastaHits != nil {
+			reference = samName(first, "template")
+			for _, hit := range fastaHits {
+				query := Sequence{ID: samName(Sequence{ID: hit.ID}, fmt.Sprintf("record%d", hit.Index+1))}
+				record, err := seqio.NewSamRecord(reference, query, hit.Length, hit.Alignment)
+				exitOnError(err)
+				// The strand of fastx hits is of the translated template, not of the protein record
+				if hit.Strand == Minus && libraryUnit == "nt" && record.Flag&seqio.SamUnmapped == 0 {
+					record.Flag |= seqio.SamReverse
+				}
+				records = append(records, record)
+			}
+		} else {
+			query := Sequence{ID: samName(second, "seq2"), Residues: seq2, Quality: second.Quality}
+			record, err := seqio.NewSamRecord(reference, query, len(seq2), alignment)
+			exitOnError(err)
+			records = append(records, record)
+		}
+		references := []seqio.SamReference{{Name: reference, Length: len(first.Residues)}}
+		exitOnError(writeSamFile(outpFile, references, records))
+	} else if outpFile != "" {
+		exitOnError(writeSeqToFile(outpFile, alignment))
+	} else if fastaHits != nil {
+		for _, hit := range fastaHits {
+			printFastaHit(hit, librarySize, libraryUnit, alignUnit)
+			printAlignment(hit.Alignment)
+			fmt.Println()
+		}
 	} else {
-		fmt.Printf("Aligned seq1:\t%s\nAligned seq2:\t%s\nScore: %d",
-			Prettify(alignedSeq1, 100), Prettify(alignedSeq2, 100), score)
+		printAlignment(alignment)
+		for _, shift := range frameshifts {
+			fmt.Printf("Frameshift %+d at nucleotide %d, column %d\n", shift.Shift, shift.Pos+1, shift.Column+1)
+		}
+	}
+	if interrupted != nil {
+		exitOnError(errors.Wrapf(interrupted, "Search stopped, the hits are of the %d records scored", librarySize))
 	}
 }
 
+func printAlignment(alignment Alignment) {
+	fmt.Printf("Aligned seq1:\t%s\nAligned seq2:\t%s\nScore: %d\n",
+		Prettify(alignment.Row1, 100), Prettify(alignment.Row2, 100), alignment.Score)
+	fmt.Printf("Positions: %d-%d, %d-%d\nIdentities: %d/%d\nSimilarities: %d/%d\nGaps: %d/%d\nCIGAR: %s\n",
+		alignment.Start1+1, alignment.End1, alignment.Start2+1, alignment.End2,
+		alignment.Identities, alignment.Length(),
+		alignment.Similarities, alignment.Length(),
+		alignment.Gaps, alignment.Length(),
+		alignment.Cigar)
+}
+
 //Aligned seq1:   LKMYGIVTTVKLANKMIQNEKFEVWDILDEVIHEHPIL
 //Aligned seq2:   LKMYGIVPTVKLANKMIQNEKPEVWDILDEVIHEHPIL
 //Score: 34
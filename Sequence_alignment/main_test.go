@@ -2,8 +2,21 @@ package main
 
 import (
 	. "Bioinformatics/Sequence_alignment/algorithm"
+	"Bioinformatics/Sequence_alignment/seqio"
 	"Bioinformatics/Sequence_alignment/utils"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
 )
 
@@ -35,10 +48,10 @@ func TestNeedlemanWunsch(t *testing.T) {
 		-1,
 	)
 	for i, test := range testsNeedlemanWunsch {
-		res1, res2, _ := engine.NeedlemanWunsch(test.seq1, test.seq2)
-		//checkTest(err, t)
-		if test.res1 != res1 || test.res2 != res2 {
-			t.Error(format(test, res1, res2))
+		res, err := engine.NeedlemanWunsch(test.seq1, test.seq2)
+		checkTest(err, t)
+		if test.res1 != res.Row1 || test.res2 != res.Row2 {
+			t.Error(format(test, res.Row1, res.Row2))
 		} else {
 			t.Log("TEST", i, "OK")
 		}
@@ -53,28 +66,113 @@ func TestGapDynamics(t *testing.T) {
 		})
 	test := test{
 		"AAAA", "AAAAAAAAAAAA",
-		"-A-A-A-A----", "AAAAAAAAAAAA",
+		"----A-A-A-A-", "AAAAAAAAAAAA",
 	}
-	res1, res2, _ := engine.NeedlemanWunsch("AAAA", "AAAAAAAAAAAA")
-	exp1, exp2 := "-A-A-A-A----", "AAAAAAAAAAAA"
-	if res1 != exp1 || res2 != exp2 {
-		t.Error(format(test, res1, res2))
+	res, err := engine.NeedlemanWunsch("AAAA", "AAAAAAAAAAAA")
+	checkTest(err, t)
+	if res.Row1 != test.res1 || res.Row2 != test.res2 {
+		t.Error(format(test, res.Row1, res.Row2))
+	} else if res.Score != -18 {
+		t.Errorf("Expected score -18, got %d", res.Score)
 	} else {
 		t.Log("OK")
 	}
 }
 
+func TestAffineGaps(t *testing.T) {
+	engine := NewAlignEngineAffine(
+		func(a byte, b byte) (i int, e error) {
+			if a == b {
+				return +2, nil
+			} else {
+				return -2, nil
+			}
+		},
+		-5, -1,
+	)
+	tests := []struct {
+		test
+		local bool
+		score int
+	}{
+		{test{"AAAATTTTAAAA", "AAAAAAAA", "AAAATTTTAAAA", "AAAA----AAAA"}, false, 8},
+		{test{"GGAAAATTTAAAACC", "AAAAAAAA", "AAAATTTAAAA", "AAAA---AAAA"}, true, 9},
+		{test{"ACGTACGT", "ACGACGT", "ACGTACGT", "ACG-ACGT"}, false, 9},
+	}
+	for i, test := range tests {
+		res, err := engine.AlignSequences(test.seq1, test.seq2, test.local)
+		checkTest(err, t)
+		if test.res1 != res.Row1 || test.res2 != res.Row2 {
+			t.Error(format(test.test, res.Row1, res.Row2))
+		} else if test.score != res.Score {
+			t.Errorf("TEST %d: expected score %d, got %d", i, test.score, res.Score)
+		} else {
+			t.Log("TEST", i, "OK")
+		}
+	}
+}
+
+func TestAlignModes(t *testing.T) {
+	engine := NewAlignEngineAffine(
+		func(a byte, b byte) (i int, e error) {
+			if a == b {
+				return +2, nil
+			} else {
+				return -2, nil
+			}
+		},
+		-5, -1,
+	)
+	tests := []struct {
+		test
+		mode           AlignMode
+		ends           *EndGaps
+		score          int
+		start1, start2 int
+	}{
+		{test{"GGGGACGTACGTCCCC", "ACGTACGT", "ACGTACGT", "ACGTACGT"}, SemiGlobal, nil, 16, 4, 0},
+		{test{"ACGT", "ACGTAA", "ACGT--", "ACGTAA"}, SemiGlobal, nil, 2, 0, 0},
+		{test{"TTTTTACGTACG", "ACGTACGGGGGG", "ACGTACG", "ACGTACG"}, Overlap, nil, 14, 5, 0},
+		{test{"ACGTTTTT", "ACG", "ACG", "ACG"}, Global, &EndGaps{Trailing1: true}, 6, 0, 0},
+		{test{"ACGTTTTT", "ACG", "ACGTTTTT", "ACG-----"}, Global, nil, 6 - 5 - 4, 0, 0},
+	}
+	for i, test := range tests {
+		engine.Mode, engine.EndGaps = test.mode, test.ends
+		res, err := engine.Align(test.seq1, test.seq2)
+		checkTest(err, t)
+		if test.res1 != res.Row1 || test.res2 != res.Row2 {
+			t.Error(format(test.test, res.Row1, res.Row2))
+		} else if test.score != res.Score {
+			t.Errorf("TEST %d: expected score %d, got %d", i, test.score, res.Score)
+		} else if test.start1 != res.Start1 || test.start2 != res.Start2 ||
+			res.End1-res.Start1 != len(strings.Replace(res.Row1, "-", "", -1)) {
+			t.Errorf("TEST %d: bad coordinates %d-%d, %d-%d", i, res.Start1, res.End1, res.Start2, res.End2)
+		} else {
+			t.Log("TEST", i, "OK")
+		}
+	}
+
+	for name, mode := range map[string]AlignMode{"glocal": SemiGlobal, "Semi-Global": SemiGlobal, "overlap": Overlap} {
+		if parsed, err := ParseAlignMode(name); err != nil || parsed != mode {
+			t.Errorf("Mode %s parsed as %v, %v", name, parsed, err)
+		}
+	}
+	if _, err := ParseAlignMode("sideways"); err == nil {
+		t.Error("Unknown mode parsed without an error")
+	}
+}
+
 func TestFasta(t *testing.T) {
-	//CalcDiagScore(BuildMatrix("AAAAA", "AAA"))
 	data := []string{
 		"CAAAABRTYUIO",
 		"CAAAAAAAAAAAAATSADBBBBS",
 		"CAAAB",
 	}
 	engine := NewAlignEngine(ScoreDefault, -2)
-	str1, str2, score, _ := engine.MultiAlignSequences("DFRFAAAAAAAIAAAAAFDEBBBBBC", data)
-	if str1 == "AAAAAAAIAAAAA" &&
-		str2 == "AAAAAAAAAAAAA" && score == 11 {
+	res, _, err := engine.MultiAlignSequences("DFRFAAAAAAAIAAAAAFDEBBBBBC", data)
+	checkTest(err, t)
+	if res.Row1 == "AAAAAAAIAAAAA" &&
+		res.Row2 == "AAAAAAAAAAAAA" && res.Score == 11 {
 		t.Log("PASSED")
 		t.Log("TEST FASTA", "OK")
 
@@ -83,6 +181,754 @@ func TestFasta(t *testing.T) {
 	}
 }
 
+func TestSequenceHeader(t *testing.T) {
+	tests := []struct {
+		header, id, description string
+	}{
+		{"sp|P09488|GSTM1_HUMAN Glutathione S-transferase Mu 1", "sp|P09488|GSTM1_HUMAN", "Glutathione S-transferase Mu 1"},
+		{"chr1", "chr1", ""},
+		{" read_7\tlength=150 ", "read_7", "length=150"},
+	}
+	for i, test := range tests {
+		seq := NewSequence(test.header, "ACGT")
+		if seq.ID != test.id || seq.Description != test.description || seq.Residues != "ACGT" {
+			t.Errorf("TEST %d: got %q %q", i, seq.ID, seq.Description)
+		} else if seq.Header() != strings.TrimSpace(strings.Replace(test.header, "\t", " ", 1)) {
+			t.Errorf("TEST %d: header %q", i, seq.Header())
+		}
+	}
+}
+
+func TestReadFastaFilePart(t *testing.T) {
+	reader := seqio.NewReader(strings.NewReader(">seq1 first\r\nACGT\r\nAC\r\n>seq2\nGGG\n\n>seq3 third record\nTT"))
+	part, isEOF, err := readFastaFilePart(reader, 2)
+	checkTest(err, t)
+	if len(part) != 2 || isEOF || part[0].ID != "seq1" || part[0].Description != "first" ||
+		part[0].Residues != "ACGTAC" || part[1].ID != "seq2" || part[1].Residues != "GGG" {
+		t.Errorf("First part: %+v, EOF %v", part, isEOF)
+	}
+	// The header of the third record must survive the end of the part
+	part, isEOF, err = readFastaFilePart(reader, 2)
+	checkTest(err, t)
+	if len(part) != 1 || !isEOF || part[0].Header() != "seq3 third record" || part[0].Residues != "TT" {
+		t.Errorf("Second part: %+v, EOF %v", part, isEOF)
+	}
+}
+
+func TestSearchRecords(t *testing.T) {
+	rnd := rand.New(rand.NewSource(24))
+	const alphabet = "ARNDCQEGHILKMFPSTWYV"
+	template := Sequence{Residues: randomSeq(rnd, alphabet, 80)}
+	var library strings.Builder
+	for i := 0; i < 2500; i++ {
+		residues := randomSeq(rnd, alphabet, 60+rnd.Intn(100))
+		if i == 1234 {
+			residues = template.Residues[5:70]
+		}
+		fmt.Fprintf(&library, ">seq%d\n%s\n", i, residues)
+	}
+	engine := NewMatrixAlignEngine(BLOSUM62, -11, -1)
+	params := DefaultFastaParams()
+	params.SkipStats = true
+	search, err := fastaSearcher(template, engine, params)
+	checkTest(err, t)
+
+	// Every number of workers gives the same chunk as one
+	var single DataChunk
+	for _, threads := range []int{1, 3, 8} {
+		res := searchRecords(context.Background(), seqio.NewReader(strings.NewReader(library.String())), search, 5, threads)
+		checkTest(res.err, t)
+		if len(res.scores) != 2500 {
+			t.Fatalf("%d threads: %d scores", threads, len(res.scores))
+		}
+		top := res.top.Sorted()
+		if top[0].ZScore != 0 || top[0].EValue != 0 {
+			t.Errorf("%d threads: statistics fitted over a batch %+v", threads, top[0])
+		}
+		if len(top) != 5 || top[0].Index != 1234 {
+			t.Errorf("%d threads: top hits %+v", threads, top)
+		}
+		if threads == 1 {
+			single = res
+			continue
+		}
+		// The scores are in the order of the records
+		if !reflect.DeepEqual(res.scores, single.scores) {
+			t.Errorf("%d threads: scores differ from one worker", threads)
+		}
+		for k, hit := range single.top.Sorted() {
+			if top[k].Index != hit.Index || top[k].Opt != hit.Opt {
+				t.Errorf("%d threads: rank %d is %d with %d, one worker has %d with %d",
+					threads, k, top[k].Index, top[k].Opt, hit.Index, hit.Opt)
+			}
+		}
+	}
+
+	// Bad records are skipped, the others keep their numbers
+	var mixed, good strings.Builder
+	for i := 0; i < 1500; i++ {
+		residues := randomSeq(rnd, alphabet, 60)
+		if i%3 == 1 {
+			residues = residues[:30] + "#" + residues[30:]
+		} else {
+			fmt.Fprintf(&good, ">seq%d\n%s\n", i, residues)
+		}
+		fmt.Fprintf(&mixed, ">seq%d\n%s\n", i, residues)
+	}
+	res := searchRecords(context.Background(), seqio.NewReader(strings.NewReader(mixed.String())), search, 5, 2)
+	checkTest(res.err, t)
+	expected := searchRecords(context.Background(), seqio.NewReader(strings.NewReader(good.String())), search, 5, 1)
+	if len(res.scores) != 1000 || !reflect.DeepEqual(res.scores, expected.scores) {
+		t.Errorf("Scores of the good records: %d, expected %d", len(res.scores), len(expected.scores))
+	}
+
+	// A failing search stops the pipeline with its error
+	failure := errors.New("search failed")
+	failing := func(ctx context.Context, sequences []Sequence) ([]FastaHit, error) {
+		return nil, failure
+	}
+	res = searchRecords(context.Background(), seqio.NewReader(strings.NewReader(library.String())), failing, 5, 4)
+	if res.err != failure {
+		t.Errorf("Expected the search error, got %v", res.err)
+	}
+	res = searchRecords(context.Background(), seqio.NewReader(strings.NewReader("@read\nACGT\n@next\n")), search, 5, 2)
+	if !errors.Is(res.err, seqio.ErrNoSeparator) {
+		t.Errorf("Expected the read error, got %v", res.err)
+	}
+}
+
+// Context canceled on the given call of Err, so that a test knows
+// the alignment stopped inside its loops
+type countdownContext struct {
+	context.Context
+	calls int
+}
+
+func (ctx *countdownContext) Err() error {
+	if ctx.calls--; ctx.calls <= 0 {
+		return context.Canceled
+	}
+	return nil
+}
+
+func TestContextCancel(t *testing.T) {
+	rnd := rand.New(rand.NewSource(25))
+	const alphabet = "ARNDCQEGHILKMFPSTWYV"
+	seq1, seq2 := randomSeq(rnd, alphabet, 700), randomSeq(rnd, alphabet, 600)
+	engine := NewMatrixAlignEngine(BLOSUM62, -11, -1)
+	engine.Mode = SemiGlobal
+	code, err := LookupGeneticCode(1)
+	checkTest(err, t)
+	records := []Sequence{{Residues: seq2}}
+	calls := map[string]func(ctx context.Context) error{
+		"NeedlemanWunsch": func(ctx context.Context) error {
+			_, err := engine.NeedlemanWunschContext(ctx, seq1, seq2)
+			return err
+		},
+		"SmithWaterman": func(ctx context.Context) error {
+			_, err := engine.SmithWatermanContext(ctx, seq1, seq2)
+			return err
+		},
+		"SmithWatermanLinear": func(ctx context.Context) error {
+			_, err := engine.SmithWatermanLinearContext(ctx, seq1, seq2)
+			return err
+		},
+		"Hirschberg": func(ctx context.Context) error {
+			_, err := engine.HirschbergContext(ctx, seq1, seq2)
+			return err
+		},
+		"Align": func(ctx context.Context) error {
+			_, err := engine.AlignContext(ctx, seq1, seq2)
+			return err
+		},
+		"AlignBanded": func(ctx context.Context) error {
+			_, _, err := engine.AlignBandedContext(ctx, seq1, seq2, 200)
+			return err
+		},
+		"ExtendSeed": func(ctx context.Context) error {
+			_, err := engine.ExtendSeedContext(ctx, seq1, seq1, 350, 350, 1000)
+			return err
+		},
+		"AlignFrameshift": func(ctx context.Context) error {
+			_, err := engine.AlignFrameshiftContext(ctx, backTranslate(seq2), seq2, code, DefaultFrameshiftPenalty)
+			return err
+		},
+		"FastaSearch": func(ctx context.Context) error {
+			_, err := engine.FastaSearchContext(ctx, seq2, records, DefaultFastaParams())
+			return err
+		},
+		"TranslatedSearch": func(ctx context.Context) error {
+			_, err := engine.TranslatedSearchContext(ctx, seq2, []Sequence{{Residues: backTranslate(seq2)}},
+				ProteinVsDNA, code, DefaultFastaParams())
+			return err
+		},
+		"MultiAlignSequences": func(ctx context.Context) error {
+			_, _, err := engine.MultiAlignSequencesContext(ctx, seq2, []string{seq2})
+			return err
+		},
+		"MultiAlignTranslated": func(ctx context.Context) error {
+			_, _, err := engine.MultiAlignTranslatedContext(ctx, seq2, []string{backTranslate(seq2)}, ProteinVsDNA, code)
+			return err
+		},
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for name, call := range calls {
+		if err := call(context.Background()); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		// The error of the context, not a *RecordError
+		if err := call(canceled); err != context.Canceled {
+			t.Errorf("%s with a canceled context: %v", name, err)
+		}
+		// Canceled in the middle of the DP loops
+		if err := call(&countdownContext{Context: context.Background(), calls: 3}); err != context.Canceled {
+			t.Errorf("%s canceled while aligning: %v", name, err)
+		}
+	}
+
+	// The search keeps the batches scored before the cancel
+	var library strings.Builder
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&library, ">seq%d\n%s\n", i, randomSeq(rnd, alphabet, 60+rnd.Intn(100)))
+	}
+	search, err := fastaSearcher(Sequence{Residues: seq2[:80]}, engine, DefaultFastaParams())
+	checkTest(err, t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	batches := 0
+	stopping := func(ctx context.Context, sequences []Sequence) ([]FastaHit, error) {
+		if batches++; batches == 2 {
+			cancel()
+		}
+		return search(ctx, sequences)
+	}
+	res := searchRecords(ctx, seqio.NewReader(strings.NewReader(library.String())), stopping, 5, 1)
+	if res.err != context.Canceled || len(res.scores) != 1000 || res.top.Len() != 5 {
+		t.Errorf("Canceled search: %v, %d scores, %d top hits", res.err, len(res.scores), res.top.Len())
+	}
+}
+
+func TestSeqioReader(t *testing.T) {
+	// Multi-line FASTQ with a quality line starting with '@'
+	reader := seqio.NewReader(strings.NewReader("\n@read1 lane 1\nACGT\nAC\n+\n@III\nII\n@read2\nGG\n+read2\n##\n"))
+	seqs, err := reader.ReadAll()
+	checkTest(err, t)
+	if reader.Format() != seqio.FASTQ || len(seqs) != 2 ||
+		seqs[0].Header() != "read1 lane 1" || seqs[0].Residues != "ACGTAC" || seqs[0].Quality != "@IIIII" ||
+		seqs[1].ID != "read2" || seqs[1].Residues != "GG" || seqs[1].Quality != "##" {
+		t.Errorf("FASTQ records: %+v", seqs)
+	}
+
+	reader = seqio.NewReader(strings.NewReader("AGTACGCA\r\n\r\nTATGC"))
+	seqs, err = reader.ReadAll()
+	checkTest(err, t)
+	if reader.Format() != seqio.Plain || len(seqs) != 2 || seqs[0].Residues != "AGTACGCA" || seqs[1].Residues != "TATGC" {
+		t.Errorf("Plain records: %+v", seqs)
+	}
+
+	malformed := []struct {
+		input string
+		line  int
+		err   error
+	}{
+		{"@read\nA\n+\nI\n@next\nACGT\n+\nIIIII\n", 8, seqio.ErrQualityLength},
+		{"@read\nACGT\n@next\n", 3, seqio.ErrNoSeparator},
+		{"@read\nACGT\n+\nII", 4, seqio.ErrTruncatedRecord},
+		{"@read\nA\n+\nI\n\nread2\n", 6, seqio.ErrNoHeader},
+		{">seq\nACGT\n", 0, nil},
+	}
+	for _, test := range malformed {
+		_, err := seqio.NewReader(strings.NewReader(test.input)).ReadAll()
+		var parseErr *seqio.ParseError
+		if test.err == nil && err != nil {
+			t.Errorf("%q: unexpected error %v", test.input, err)
+		} else if test.err != nil && (!errors.As(err, &parseErr) || parseErr.Line != test.line || !errors.Is(err, test.err)) {
+			t.Errorf("%q: expected %v at line %d, got %v", test.input, test.err, test.line, err)
+		}
+	}
+}
+
+func TestCompressedInput(t *testing.T) {
+	// Two gzip members with the BGZF subfield, read as one stream
+	var compressed bytes.Buffer
+	for _, part := range []string{">seq1\nACGT\n", ">seq2\nGG\n"} {
+		writer := gzip.NewWriter(&compressed)
+		writer.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+		_, err := writer.Write([]byte(part))
+		checkTest(err, t)
+		checkTest(writer.Close(), t)
+	}
+	reader := seqio.NewReader(bytes.NewReader(compressed.Bytes()))
+	seqs, err := reader.ReadAll()
+	checkTest(err, t)
+	if reader.Compression() != seqio.BGZF || len(seqs) != 2 || seqs[0].Residues != "ACGT" || seqs[1].ID != "seq2" {
+		t.Errorf("BGZF records: %+v, compression %v", seqs, reader.Compression())
+	}
+
+	// The alignment written to a .gz file reads back as the plain pair
+	path := filepath.Join(t.TempDir(), "res.txt.gz")
+	checkTest(writeSeqToFile(path, Alignment{Row1: "AC-T", Row2: "ACGT", Score: 3}), t)
+	seq1, seq2, err := readFile(path)
+	checkTest(err, t)
+	if seq1.Residues != "AC-T" || seq2.Residues != "ACGT" {
+		t.Errorf("Read back %q and %q", seq1.Residues, seq2.Residues)
+	}
+	raw, err := os.ReadFile(path)
+	checkTest(err, t)
+	if !bytes.HasPrefix(raw, []byte{0x1f, 0x8b}) {
+		t.Errorf("Output is not gzip: %q", raw)
+	}
+}
+
+func TestFaiIndex(t *testing.T) {
+	const fasta = ">chr1 first\nACGTA\nCGTAC\nGT\n>chr2\nTTTT\r\nGG\r\n"
+	index, err := seqio.BuildFaiIndex(strings.NewReader(fasta))
+	checkTest(err, t)
+	var fai strings.Builder
+	checkTest(index.Write(&fai), t)
+	// The same as samtools faidx writes
+	if expected := "chr1\t12\t12\t5\t6\nchr2\t6\t33\t4\t6\n"; fai.String() != expected {
+		t.Errorf("Expected index %q, got %q", expected, fai.String())
+	}
+	read, err := seqio.ReadFaiIndex(strings.NewReader(fai.String()))
+	checkTest(err, t)
+	if fmt.Sprint(read.Entries) != fmt.Sprint(index.Entries) {
+		t.Errorf("Index read back as %v", read.Entries)
+	}
+
+	indexed := seqio.NewIndexedFasta(strings.NewReader(fasta), index)
+	for region, expected := range map[string]string{
+		"chr1":         "ACGTACGTACGT",
+		"chr1:4-8":     "TACGT",
+		"chr1:1,0-1,1": "CG",
+		"chr2:3":       "TTGG",
+		"chr2:5-100":   "GG",
+	} {
+		seq, err := indexed.Fetch(region)
+		checkTest(err, t)
+		if seq.Residues != expected {
+			t.Errorf("Region %s: expected %s, got %s", region, expected, seq.Residues)
+		}
+	}
+	if _, err := indexed.Fetch("chr3:1-2"); !errors.Is(err, seqio.ErrUnknownRecord) {
+		t.Errorf("Unknown record fetched with %v", err)
+	}
+	for _, region := range []string{"chr1:0-5", "chr1:5-4", "chr1:a-b", ":1-2"} {
+		if _, err := seqio.ParseRegion(region); err != seqio.ErrRegion {
+			t.Errorf("Region %q parsed with %v", region, err)
+		}
+	}
+	_, err = seqio.BuildFaiIndex(strings.NewReader(">chr1\nACG\nACGT\n"))
+	if !errors.Is(err, seqio.ErrLineLength) {
+		t.Errorf("Ragged lines indexed with %v", err)
+	}
+
+	// The region of the input is read through the index, saved next to the file
+	path := filepath.Join(t.TempDir(), "ref.fa")
+	checkTest(os.WriteFile(path, []byte(fasta), 0644), t)
+	seqs, err := readSequences(path+":chr1:2-3", 1)
+	checkTest(err, t)
+	if len(seqs) != 1 || seqs[0].ID != "chr1:2-3" || seqs[0].Residues != "CG" {
+		t.Errorf("Region read as %+v", seqs)
+	}
+	if saved, err := os.ReadFile(path + ".fai"); err != nil || string(saved) != fai.String() {
+		t.Errorf("Saved index %q, %v", saved, err)
+	}
+}
+
+func TestCigar(t *testing.T) {
+	cigar, err := ParseCigar("2H3S10=1X2I4D1N5M3S")
+	checkTest(err, t)
+	length1, length2 := cigar.Lengths()
+	if cigar.String() != "2H3S10=1X2I4D1N5M3S" || len(cigar) != 9 || length1 != 21 || length2 != 26 {
+		t.Errorf("Parsed %v with lengths %d and %d", cigar, length1, length2)
+	}
+	for _, bad := range []string{"10", "M", "0M", "3Q", "5M2H3M", "3M2S3M", "2S2H5M"} {
+		var cigarErr *CigarError
+		if _, err := ParseCigar(bad); !errors.As(err, &cigarErr) {
+			t.Errorf("CIGAR %q parsed with %v", bad, err)
+		}
+	}
+
+	engine := NewMatrixAlignEngine(DNAFull, -10, -1)
+	if cigar := engine.RowsCigar("AC-GTT", "ACAG-A").String(); cigar != "2=1I1=1D1X" {
+		t.Errorf("Rows CIGAR %s", cigar)
+	}
+	alignment, err := engine.AlignmentFromCigar("TTACGTT", "GACAGAC", 2, "1H2M1I1=1D1X1S")
+	checkTest(err, t)
+	if alignment.Row1 != "AC-GTT" || alignment.Row2 != "ACAG-A" || alignment.Cigar != "2=1I1=1D1X" ||
+		alignment.Start1 != 2 || alignment.End1 != 7 || alignment.Start2 != 1 || alignment.End2 != 6 {
+		t.Errorf("Rebuilt %+v", alignment)
+	}
+	for _, bad := range []string{"1H2M1I1X1D1X1S", "1H2M1I1=1D1X", "1H3M1I1=1D1X"} {
+		if _, err := engine.AlignmentFromCigar("TTACGTT", "GACAGAC", 2, bad); err == nil {
+			t.Errorf("CIGAR %s does not fit, but rebuilt", bad)
+		}
+	}
+
+	// Local alignments survive the clipped CIGAR
+	rnd := rand.New(rand.NewSource(20))
+	for k := 0; k < 200; k++ {
+		seq1, seq2 := randomSeq(rnd, "ACGT", 1+rnd.Intn(60)), randomSeq(rnd, "ACGT", 1+rnd.Intn(60))
+		res, err := engine.SmithWaterman(seq1, seq2)
+		checkTest(err, t)
+		clipped, err := res.ClippedCigar(len(seq2), 'S')
+		checkTest(err, t)
+		rebuilt, err := engine.AlignmentFromCigar(seq1, seq2, res.Start1, clipped.String())
+		checkTest(err, t)
+		if rebuilt != res {
+			t.Errorf("%s %s: %+v rebuilt from %s as %+v", seq1, seq2, res, clipped, rebuilt)
+		}
+	}
+}
+
+func TestSamRecord(t *testing.T) {
+	alignment := Alignment{Row1: "AAGGTT-CC", Row2: "AA--TAGCC", Score: 7,
+		Start1: 3, End1: 11, Start2: 1, End2: 8, Cigar: "2=2D1=1X1I2="}
+	query := Sequence{ID: "read1", Residues: "GAATAGCCTT", Quality: "IIIIIIIIII"}
+	var sam strings.Builder
+	writer, err := seqio.NewSamWriter(&sam, []seqio.SamReference{{Name: "chr1", Length: 20}})
+	checkTest(err, t)
+	// The search keeps no whole library sequence, its ends are hard-clipped
+	for _, record := range []struct {
+		query     Sequence
+		alignment Alignment
+	}{{query, alignment}, {Sequence{ID: "hit"}, alignment}, {Sequence{ID: "none"}, Alignment{}}} {
+		samRecord, err := seqio.NewSamRecord("chr1", record.query, 10, record.alignment)
+		checkTest(err, t)
+		checkTest(writer.Write(samRecord), t)
+	}
+	checkTest(writer.Close(), t)
+	expected := "@HD\tVN:1.6\tSO:unsorted\n@SQ\tSN:chr1\tLN:20\n@PG\tID:Sequence_alignment\tPN:Sequence_alignment\n" +
+		"read1\t0\tchr1\t4\t255\t1S2=2D1=1X1I2=2S\t*\t0\t0\tGAATAGCCTT\tIIIIIIIIII\tAS:i:7\tNM:i:4\tMD:Z:2^GG1T2\n" +
+		"hit\t0\tchr1\t4\t255\t1H2=2D1=1X1I2=2H\t*\t0\t0\tAATAGCC\t*\tAS:i:7\tNM:i:4\tMD:Z:2^GG1T2\n" +
+		"none\t4\t*\t0\t0\t*\t*\t0\t0\t*\t*\n"
+	if sam.String() != expected {
+		t.Errorf("Expected SAM\n%s\ngot\n%s", expected, sam.String())
+	}
+
+	var bam bytes.Buffer
+	bamWriter, err := seqio.NewBamWriter(&bam, []seqio.SamReference{{Name: "chr1", Length: 20}})
+	checkTest(err, t)
+	samRecord, err := seqio.NewSamRecord("chr1", query, len(query.Residues), alignment)
+	checkTest(err, t)
+	checkTest(bamWriter.Write(samRecord), t)
+	checkTest(bamWriter.Close(), t)
+	// Every BGZF block records its size, the last one is the empty end of file block
+	raw := bam.Bytes()
+	blocks, size := 0, 0
+	for offset := 0; offset < len(raw); offset += size {
+		size = int(binary.LittleEndian.Uint16(raw[offset+16:])) + 1
+		blocks++
+		if offset+size > len(raw) || (offset+size == len(raw) && size != 28) {
+			t.Fatalf("Broken BGZF block at %d", offset)
+		}
+	}
+	unzipped, err := gzip.NewReader(bytes.NewReader(raw))
+	checkTest(err, t)
+	data, err := io.ReadAll(unzipped)
+	checkTest(err, t)
+	text := binary.LittleEndian.Uint32(data[4:])
+	record := data[8+text+4+4+5+4+4:]
+	refID, position := int32(binary.LittleEndian.Uint32(record[0:])), binary.LittleEndian.Uint32(record[4:])
+	cigarOps, seqLength := binary.LittleEndian.Uint16(record[12:]), binary.LittleEndian.Uint32(record[16:])
+	if blocks != 2 || !bytes.HasPrefix(data, []byte("BAM\x01")) || refID != 0 || position != 3 || cigarOps != 8 || seqLength != 10 {
+		t.Errorf("BAM record %d:%d, %d CIGAR ops, %d residues in %d blocks", refID, position, cigarOps, seqLength, blocks)
+	}
+}
+
+func TestKmerIndex(t *testing.T) {
+	index, err := NewKmerIndex(DNAFull, "ACGTACGTTT", 3)
+	checkTest(err, t)
+	diagonals, err := index.DiagonalHits("CGTACG")
+	checkTest(err, t)
+	// CGT, GTA, TAC, ACG of the sequence against the template
+	expected := map[int][]int{1: {0, 1, 2, 3}, 5: {0}, -3: {3}}
+	if fmt.Sprint(diagonals) != fmt.Sprint(expected) {
+		t.Errorf("Expected hits %v, got %v", expected, diagonals)
+	}
+	count, diag, first, last := BestDiagonal(diagonals)
+	if count != 4 || diag != 1 || first != (Coordinate{I: 1, J: 0}) || last != (Coordinate{I: 4, J: 3}) {
+		t.Errorf("Best diagonal %d with %d hits from %v to %v", diag, count, first, last)
+	}
+
+	if _, err := NewKmerIndex(BLOSUM62, "ARND", 20); err == nil {
+		t.Error("Too long words indexed without an error")
+	}
+
+	// A long template costs memory in the number of hits only
+	rnd := rand.New(rand.NewSource(6))
+	template := randomSeq(rnd, "ACGT", 200_000)
+	index, err = NewKmerIndex(DNAFull, template, 12)
+	checkTest(err, t)
+	diagonals, err = index.DiagonalHits(template[150_000:150_100])
+	checkTest(err, t)
+	if count, diag, _, _ := BestDiagonal(diagonals); count != 89 || diag != 150_000 {
+		t.Errorf("Best diagonal %d with %d hits", diag, count)
+	}
+}
+
+func TestFastaSearch(t *testing.T) {
+	engine := NewMatrixAlignEngine(BLOSUM62, -11, -1)
+	rnd := rand.New(rand.NewSource(5))
+	const alphabet = "ARNDCQEGHILKMFPSTWYV"
+	template := randomSeq(rnd, alphabet, 120)
+	// Homolog: a few substitutions and a deletion inside a random context
+	homolog := []byte(template[20:100])
+	for k := 0; k < 8; k++ {
+		homolog[rnd.Intn(len(homolog))] = alphabet[rnd.Intn(len(alphabet))]
+	}
+	homolog = append(homolog[:40], homolog[44:]...)
+	library := make([]Sequence, 50)
+	residues := make([]string, len(library))
+	for i := range library {
+		residues[i] = randomSeq(rnd, alphabet, 80+rnd.Intn(80))
+	}
+	residues[17] = randomSeq(rnd, alphabet, 30) + string(homolog) + randomSeq(rnd, alphabet, 30)
+	for i := range library {
+		library[i] = NewSequence(fmt.Sprintf("sp|%05d| random protein", i), residues[i])
+	}
+
+	hits, err := engine.FastaSearch(template, library, DefaultFastaParams())
+	checkTest(err, t)
+	if hits[17].ID != "sp|00017|" || hits[17].Description != "random protein" {
+		t.Errorf("Hit 17 is named %q %q", hits[17].ID, hits[17].Description)
+	}
+	for i, hit := range hits {
+		if hit.Index != i || hit.Init1 > hit.Initn || hit.Init1 > hit.Opt {
+			t.Errorf("Hit %d: initn %d init1 %d opt %d", hit.Index, hit.Initn, hit.Init1, hit.Opt)
+		}
+		if i != 17 && hit.ZScore >= hits[17].ZScore {
+			t.Errorf("Random sequence %d: Z-score %.1f over the homolog %.1f", i, hit.ZScore, hits[17].ZScore)
+		}
+	}
+	sw, err := engine.SmithWaterman(template, residues[17])
+	checkTest(err, t)
+	if hits[17].Opt != sw.Score || hits[17].Alignment.Score != sw.Score || hits[17].EValue > 1e-3 {
+		t.Errorf("Homolog: opt %d, Smith-Waterman %d, E() %g", hits[17].Opt, sw.Score, hits[17].EValue)
+	}
+
+	_, index, err := engine.MultiAlignSequences(template, residues)
+	checkTest(err, t)
+	if index != 17 {
+		t.Errorf("Best sequence %d, expected 17", index)
+	}
+	if _, err := engine.FastaSearch(template, library, FastaParams{}); err != ErrFastaParams {
+		t.Errorf("Expected ErrFastaParams, got %v", err)
+	}
+}
+
+func TestFastaStrands(t *testing.T) {
+	engine := NewMatrixAlignEngine(DNAFull, -16, -4)
+	rnd := rand.New(rand.NewSource(21))
+	template := randomSeq(rnd, "ACGT", 200)
+	library := make([]Sequence, 30)
+	for i := range library {
+		library[i] = Sequence{ID: fmt.Sprint(i), Residues: randomSeq(rnd, "ACGT", 150+rnd.Intn(100))}
+	}
+	// The amplicon sits on the minus strand of record 7
+	library[7].Residues = randomSeq(rnd, "ACGT", 40) + utils.ReverseComplement(template[50:150]) + randomSeq(rnd, "ACGT", 40)
+	params := DefaultFastaParams()
+	params.Ktup = 6
+
+	plus, err := engine.FastaSearch(template, library, params)
+	checkTest(err, t)
+	for _, strand := range []Strand{Minus, Both} {
+		params.Strand = strand
+		hits, err := engine.FastaSearch(template, library, params)
+		checkTest(err, t)
+		hit := hits[7]
+		// The random flanks may extend the amplicon by a few residues
+		if hit.Strand != Minus || hit.Opt < 500 || plus[7].Opt > 100 ||
+			hit.Alignment.Start1 != 50 || hit.Alignment.Start2 != 40 || hit.Alignment.End2 < 140 {
+			t.Errorf("%v strand: hit %+v, plus opt %d", strand, hit, plus[7].Opt)
+		}
+		for i := range hits {
+			if strand == Both && i != 7 && hits[i].Opt < plus[i].Opt {
+				t.Errorf("Record %d: both strands opt %d, plus strand %d", i, hits[i].Opt, plus[i].Opt)
+			}
+		}
+	}
+	protein := NewMatrixAlignEngine(BLOSUM62, -11, -1)
+	if _, err := protein.FastaSearch("ARND", []Sequence{{Residues: "ARND"}}, params); !errors.Is(err, ErrStrandProtein) {
+		t.Errorf("Both strands of proteins searched, error %v", err)
+	}
+	if _, err := ParseStrand("sideways"); err == nil {
+		t.Error("Unknown strand parsed")
+	}
+}
+
+func TestGeneticCode(t *testing.T) {
+	standard, err := LookupGeneticCode(1)
+	checkTest(err, t)
+	mito, err := LookupGeneticCode(2)
+	checkTest(err, t)
+	cephalodiscidae, err := LookupGeneticCode(33)
+	checkTest(err, t)
+	if _, err := LookupGeneticCode(7); err == nil {
+		t.Error("Genetic code 7 was withdrawn, but found")
+	}
+	const dna = "ATGGCUtggTGAAGAGCNTAR"
+	for _, test := range []struct {
+		code     *GeneticCode
+		frame    int
+		expected string
+	}{
+		// GCN is Ala whatever N is and TAR is a stop of either base, CNT is ambiguous
+		{standard, 1, "MAW*RA*"},
+		{standard, 2, "WLGEEX"},
+		{standard, 3, "GLVKSX"},
+		{mito, 1, "MAWW*A*"},
+		{cephalodiscidae, 1, "MAWWSAX"},
+		{standard, -1, "LXSSPSH"},
+		{standard, -3, "XLFTKP"},
+	} {
+		if res := test.code.Translate(dna, test.frame); res != test.expected {
+			t.Errorf("Code %d frame %+d: expected %s, got %s", test.code.ID, test.frame, test.expected, res)
+		}
+	}
+	for frame, expected := range map[int][2]int{1: {3, 9}, 3: {5, 11}, -1: {12, 18}, -2: {11, 17}} {
+		if start, end := FrameToNucleotide(frame, 1, 3, 21); start != expected[0] || end != expected[1] {
+			t.Errorf("Frame %+d: residues 1-3 at nucleotides %d-%d", frame, start, end)
+		}
+	}
+}
+
+// Nucleotides coding the protein, one codon per amino acid
+func backTranslate(protein string) string {
+	codons := map[byte]string{'A': "GCT", 'R': "CGT", 'N': "AAC", 'D': "GAT", 'C': "TGC", 'Q': "CAA", 'E': "GAA",
+		'G': "GGC", 'H': "CAT", 'I': "ATT", 'L': "CTG", 'K': "AAA", 'M': "ATG", 'F': "TTT", 'P': "CCG", 'S': "TCT",
+		'T': "ACC", 'W': "TGG", 'Y': "TAT", 'V': "GTT"}
+	var sb strings.Builder
+	for k := 0; k < len(protein); k++ {
+		sb.WriteString(codons[protein[k]])
+	}
+	return sb.String()
+}
+
+func TestTranslatedSearch(t *testing.T) {
+	engine := NewMatrixAlignEngine(BLOSUM62, -11, -1)
+	code, err := LookupGeneticCode(1)
+	checkTest(err, t)
+	rnd := rand.New(rand.NewSource(22))
+	const alphabet = "ARNDCQEGHILKMFPSTWYV"
+	protein := randomSeq(rnd, alphabet, 100)
+	coding := backTranslate(protein[10:90])
+
+	// tfastx: the protein on the minus strand of record 5
+	library := make([]Sequence, 40)
+	for i := range library {
+		library[i].Residues = randomSeq(rnd, "ACGT", 250+rnd.Intn(200))
+	}
+	library[5].Residues = library[5].Residues[:101] + utils.ReverseComplement(coding) + library[5].Residues[101:]
+	params := DefaultFastaParams()
+	params.Strand = Both
+	hits, err := engine.TranslatedSearch(protein, library, ProteinVsDNA, code, params)
+	checkTest(err, t)
+	hit := hits[5]
+	if hit.Frame >= 0 || hit.Strand != Minus || hit.Alignment.Start1 > 10 || hit.Alignment.End1 < 90 ||
+		hit.NucleotideStart > 101 || hit.NucleotideEnd < 101+len(coding) || hit.Length != len(library[5].Residues) {
+		t.Errorf("tfastx hit: frame %+d, template %d-%d, nucleotides %d-%d",
+			hit.Frame, hit.Alignment.Start1, hit.Alignment.End1, hit.NucleotideStart, hit.NucleotideEnd)
+	}
+	for i := range hits {
+		if i != 5 && hits[i].ZScore >= hit.ZScore {
+			t.Errorf("Random record %d: Z-score %.1f over the homolog %.1f", i, hits[i].ZScore, hit.ZScore)
+		}
+	}
+
+	// fastx: the coding template in frame +3 against the protein library
+	proteins := make([]string, 40)
+	for i := range proteins {
+		proteins[i] = randomSeq(rnd, alphabet, 100+rnd.Intn(100))
+	}
+	proteins[9] = proteins[9][:20] + protein + proteins[9][20:]
+	alignment, index, err := engine.MultiAlignTranslated("AC"+coding+"G", proteins, DNAVsProtein, code)
+	checkTest(err, t)
+	if index != 9 || alignment.Row1 != protein[10:90] || alignment.Start2 != 30 {
+		t.Errorf("fastx: best sequence %d, alignment %+v", index, alignment)
+	}
+	records := make([]Sequence, len(proteins))
+	for i := range proteins {
+		records[i].Residues = proteins[i]
+	}
+	hits, err = engine.TranslatedSearch("AC"+coding+"G", records, DNAVsProtein, code, params)
+	checkTest(err, t)
+	if hit := hits[9]; hit.Frame != 3 || hit.Strand != Plus || hit.NucleotideStart != 2 || hit.NucleotideEnd != 2+len(coding) {
+		t.Errorf("fastx hit: frame %+d, nucleotides %d-%d", hit.Frame, hit.NucleotideStart, hit.NucleotideEnd)
+	}
+}
+
+func TestAlignFrameshift(t *testing.T) {
+	engine := NewMatrixAlignEngine(BLOSUM62, -11, -1)
+	rnd := rand.New(rand.NewSource(23))
+	protein := randomSeq(rnd, "ARNDCQEGHILKMFPSTWYV", 80)
+	coding := backTranslate(protein)
+	flank1, flank2 := randomSeq(rnd, "ACGT", 20), randomSeq(rnd, "ACGT", 20)
+
+	alignment, err := engine.AlignFrameshift(flank1+coding+flank2, protein, nil, DefaultFrameshiftPenalty)
+	checkTest(err, t)
+	if len(alignment.Frameshifts) != 0 || alignment.Row1 != protein || alignment.Start1 != 20 || alignment.End1 != 20+len(coding) {
+		t.Errorf("In frame: %+v", alignment)
+	}
+
+	// A base inserted after codon 30 and the first base of codon 50 deleted
+	shifted := coding[:90] + "A" + coding[90:150] + coding[151:]
+	alignment, err = engine.AlignFrameshift(flank1+shifted+flank2, protein, nil, DefaultFrameshiftPenalty)
+	checkTest(err, t)
+	shifts := alignment.Frameshifts
+	if len(shifts) != 2 || shifts[0].Shift != 1 || shifts[1].Shift != -1 {
+		t.Fatalf("Expected frameshifts +1 and -1, got %+v", shifts)
+	}
+	if shifts[0].Pos < 20+87 || shifts[0].Pos > 20+93 || shifts[1].Pos < 20+148 || shifts[1].Pos > 20+154 {
+		t.Errorf("Frameshift positions %+v", shifts)
+	}
+	if alignment.Row1[shifts[0].Column] != protein[shifts[0].Column] || shifts[1].Column <= shifts[0].Column {
+		t.Errorf("Frameshift columns %+v in %s", shifts, alignment.Row1)
+	}
+	if alignment.Row2 != protein || alignment.Start1 != 20 || alignment.End1 != 20+len(shifted) ||
+		alignment.Identities < len(protein)-2 || alignment.Gaps != 0 {
+		t.Errorf("Frameshift alignment %+v", alignment)
+	}
+
+	// Non-matching sequences give an empty alignment
+	alignment, err = engine.AlignFrameshift("CCCCCC", "W", nil, DefaultFrameshiftPenalty)
+	checkTest(err, t)
+	if alignment.Length() != 0 || alignment.Frameshifts != nil {
+		t.Errorf("Expected no alignment, got %+v", alignment)
+	}
+}
+
+func TestTopHits(t *testing.T) {
+	rnd := rand.New(rand.NewSource(7))
+	all := make([]FastaHit, 100)
+	for i := range all {
+		all[i] = FastaHit{Index: i, Opt: rnd.Intn(30)}
+	}
+	// Two workers, each keeps its own heap
+	left, right := NewTopHits(5), NewTopHits(5)
+	for _, hit := range all[:60] {
+		left.Add(hit)
+	}
+	for _, hit := range all[60:] {
+		right.Add(hit)
+	}
+	left.Merge(right)
+
+	sort.SliceStable(all, func(a, b int) bool { return all[a].Opt > all[b].Opt })
+	top := left.Sorted()
+	if len(top) != 5 {
+		t.Fatalf("Expected 5 hits, got %d", len(top))
+	}
+	for k, hit := range top {
+		if hit.Index != all[k].Index || hit.Opt != all[k].Opt {
+			t.Errorf("Rank %d: expected hit %d with opt %d, got %d with %d",
+				k, all[k].Index, all[k].Opt, hit.Index, hit.Opt)
+		}
+	}
+}
+
 func TestHirschberg(t *testing.T) {
 	engine := NewAlignEngine(
 		func(a byte, b byte) (i int, e error) {
@@ -95,19 +941,75 @@ func TestHirschberg(t *testing.T) {
 		-2,
 	)
 
-	res1A, res2A, _ := engine.NeedlemanWunsch("AGTACGCA", "TATGC")
-	//checkTest(err, t)
-	//res1B, res2B, err := engine.Hirschberg( "G", "GC")
+	resA, err := engine.NeedlemanWunsch("AGTACGCA", "TATGC")
+	checkTest(err, t)
+	//resB, err := engine.Hirschberg( "G", "GC")
 
-	res1B, res2B := engine.Hirschberg("AGTACGCA", "TATGC")
-	//checkTest(err, t)
+	resB, err := engine.Hirschberg("AGTACGCA", "TATGC")
+	checkTest(err, t)
 
-	if res1A != res1B || res2A != res2B {
+	if resA.Row1 != resB.Row1 || resA.Row2 != resB.Row2 || resA.Score != resB.Score {
 		t.Error("Needleman-Wunsch and Hirschberg results mismatch!")
-		t.Errorf("\n%v\t%v\n%v\t%v", res1A, res2A, res1B, res2B)
+		t.Errorf("\n%v\t%v\t%d\n%v\t%v\t%d", resA.Row1, resA.Row2, resA.Score, resB.Row1, resB.Row2, resB.Score)
 	} else {
 		t.Log("OK")
 	}
+
+	// The gaps of TestGapDynamics extend for more than they open
+	dynamic := NewAlignEngineDyn(ScoreDefault, func(gapsInRow int) int {
+		return -2 - gapsInRow*2
+	})
+	res, err := dynamic.Hirschberg("AAAA", "AAAAAAAAAAAA")
+	checkTest(err, t)
+	if res.Score != -18 {
+		t.Errorf("Expected score -18, got %s %s %d", res.Row1, res.Row2, res.Score)
+	}
+
+	// Myers-Miller split must give the Gotoh score for any gap costs
+	engines := []AlignEngine{
+		NewMatrixAlignEngine(DNAFull, -6, -6),
+		NewMatrixAlignEngine(DNAFull, -10, -1),
+		NewMatrixAlignEngine(DNAFull, -3, -2),
+		NewMatrixAlignEngine(DNAFull, -2, -4),
+		NewMatrixAlignEngine(DNAFull, -1, -3),
+		NewMatrixAlignEngine(BLOSUM62, -11, -1),
+		NewMatrixAlignEngine(BLOSUM62, -4, -6),
+	}
+	rnd := rand.New(rand.NewSource(1))
+	for _, engine := range engines {
+		alphabet := "ACGT"
+		if engine.Matrix == BLOSUM62 {
+			alphabet = "ARNDCQEGHILKMFPSTWYV"
+		}
+		for i := 0; i < 200; i++ {
+			seq1, seq2 := randomSeq(rnd, alphabet, rnd.Intn(40)), randomSeq(rnd, alphabet, rnd.Intn(40))
+			resA, err := engine.NeedlemanWunsch(seq1, seq2)
+			checkTest(err, t)
+			resB, err := engine.Hirschberg(seq1, seq2)
+			checkTest(err, t)
+			if resA.Score != resB.Score || rescore(t, engine, resB) != resB.Score ||
+				strings.Replace(resB.Row1, "-", "", -1) != seq1 || strings.Replace(resB.Row2, "-", "", -1) != seq2 {
+				t.Errorf("%d/%d %s %s: Needleman-Wunsch score %d, Hirschberg %s %s score %d",
+					engine.GapOpen, engine.GapExtend, seq1, seq2, resA.Score, resB.Row1, resB.Row2, resB.Score)
+			}
+		}
+	}
+}
+
+// Score of the rows of the alignment, computed again from its CIGAR
+func rescore(t *testing.T, engine AlignEngine, alignment Alignment) int {
+	seq1, seq2 := strings.Replace(alignment.Row1, "-", "", -1), strings.Replace(alignment.Row2, "-", "", -1)
+	rows, err := engine.AlignmentFromCigar(seq1, seq2, 0, alignment.Cigar)
+	checkTest(err, t)
+	return rows.Score
+}
+
+func randomSeq(rnd *rand.Rand, alphabet string, length int) string {
+	seq := make([]byte, length)
+	for i := range seq {
+		seq[i] = alphabet[rnd.Intn(len(alphabet))]
+	}
+	return string(seq)
 }
 
 func TestSmithWaterman(t *testing.T) {
@@ -122,14 +1024,356 @@ func TestSmithWaterman(t *testing.T) {
 		-1,
 	)
 	for i, test := range testsSmithWaterman {
-		res1, res2, _ := engine.SmithWaterman(test.seq1, test.seq2)
-		//checkTest(err, t)
-		if test.res1 != res1 || test.res2 != res2 {
-			t.Error(format(test, res1, res2))
+		res, err := engine.SmithWaterman(test.seq1, test.seq2)
+		checkTest(err, t)
+		if test.res1 != res.Row1 || test.res2 != res.Row2 {
+			t.Error(format(test, res.Row1, res.Row2))
+		} else {
+			t.Log("TEST", i, "OK")
+		}
+	}
+}
+
+func TestSmithWatermanLinear(t *testing.T) {
+	engine := NewAlignEngine(
+		func(a byte, b byte) (i int, e error) {
+			if a == b {
+				return +2, nil
+			} else {
+				return -2, nil
+			}
+		},
+		-1,
+	)
+	// Rows of equal score may differ from SmithWaterman, which aligns the shorter sequence first
+	for i, test := range testsSmithWaterman {
+		resA, err := engine.SmithWaterman(test.seq1, test.seq2)
+		checkTest(err, t)
+		resB, err := engine.SmithWatermanLinear(test.seq1, test.seq2)
+		checkTest(err, t)
+		if resA.Score != resB.Score {
+			t.Errorf("TEST %d: Smith-Waterman score %d, linear score %d", i, resA.Score, resB.Score)
 		} else {
 			t.Log("TEST", i, "OK")
 		}
 	}
+
+	// Including gaps that extend for more than they open
+	rnd := rand.New(rand.NewSource(2))
+	for _, dna := range []AlignEngine{
+		NewMatrixAlignEngine(DNAFull, -10, -1),
+		NewMatrixAlignEngine(DNAFull, -2, -4),
+		NewMatrixAlignEngine(DNAFull, -1, -3),
+	} {
+		for i := 0; i < 200; i++ {
+			seq1, seq2 := randomSeq(rnd, "ACGT", 1+rnd.Intn(40)), randomSeq(rnd, "ACGT", 1+rnd.Intn(40))
+			resA, err := dna.SmithWaterman(seq1, seq2)
+			checkTest(err, t)
+			resB, err := dna.SmithWatermanLinear(seq1, seq2)
+			checkTest(err, t)
+			if resA.Score != resB.Score || rescore(t, dna, resB) != resB.Score {
+				t.Errorf("%d/%d %s %s: Smith-Waterman score %d, linear %s %s score %d", dna.GapOpen, dna.GapExtend,
+					seq1, seq2, resA.Score, resB.Row1, resB.Row2, resB.Score)
+			} else if seq1[resB.Start1:resB.End1] != strings.Replace(resB.Row1, "-", "", -1) ||
+				seq2[resB.Start2:resB.End2] != strings.Replace(resB.Row2, "-", "", -1) {
+				t.Errorf("%s %s: bad coordinates %+v", seq1, seq2, resB)
+			}
+		}
+	}
+}
+
+func TestBandedAlignment(t *testing.T) {
+	engine := NewMatrixAlignEngine(DNAFull, -10, -1)
+	rnd := rand.New(rand.NewSource(3))
+	for i := 0; i < 100; i++ {
+		seq1 := randomSeq(rnd, "ACGT", 50+rnd.Intn(100))
+		// A few substitutions and indels
+		seq2 := []byte(seq1)
+		for k := 0; k < 3; k++ {
+			pos := rnd.Intn(len(seq2))
+			switch rnd.Intn(3) {
+			case 0:
+				seq2[pos] = "ACGT"[rnd.Intn(4)]
+			case 1:
+				seq2 = append(seq2[:pos], seq2[pos+1:]...)
+			default:
+				seq2 = append(seq2[:pos], append([]byte{'A'}, seq2[pos:]...)...)
+			}
+		}
+		resA, err := engine.NeedlemanWunsch(seq1, string(seq2))
+		checkTest(err, t)
+		resB, edge, err := engine.AlignBanded(seq1, string(seq2), 0)
+		checkTest(err, t)
+		if resA.Score != resB.Score || edge {
+			t.Errorf("%s %s: Needleman-Wunsch score %d, banded score %d, band edge %v",
+				seq1, seq2, resA.Score, resB.Score, edge)
+		}
+	}
+
+	res, edge, err := engine.AlignBanded("ACGTACGT", "ACGTTACGT", 1)
+	checkTest(err, t)
+	if res.Row1 != "ACG-TACGT" && res.Row1 != "ACGT-ACGT" || !edge {
+		t.Errorf("Band 1: %s %s, band edge %v", res.Row1, res.Row2, edge)
+	}
+	if _, _, err := engine.AlignBanded("ACGTACGT", "ACGTTTTACGT", 2); err != ErrBandTooNarrow {
+		t.Errorf("Expected ErrBandTooNarrow, got %v", err)
+	}
+
+	engine.Mode = SemiGlobal
+	res, _, err = engine.AlignBanded("GGACGTACGTCC", "ACGTACGT", 0)
+	checkTest(err, t)
+	if res.Row1 != "ACGTACGT" || res.Row2 != "ACGTACGT" || res.Start1 != 2 {
+		t.Errorf("Semi-global: %s %s from %d", res.Row1, res.Row2, res.Start1)
+	}
+	engine.Mode = Local
+	if _, _, err := engine.AlignBanded("ACGT", "ACGT", 0); err != ErrBandedLocal {
+		t.Errorf("Expected ErrBandedLocal, got %v", err)
+	}
+}
+
+func TestExtendSeed(t *testing.T) {
+	engine := NewMatrixAlignEngine(DNAFull, -10, -1)
+	res, err := engine.ExtendSeed("TTTTTTACGTACGTACGTGGGGGG", "CCCCACGTACGTACGTAAAA", 9, 7, 10)
+	checkTest(err, t)
+	if res.Row1 != "ACGTACGTACGT" || res.Row2 != "ACGTACGTACGT" || res.Score != 60 ||
+		res.Start1 != 6 || res.Start2 != 4 {
+		t.Errorf("Got %s %s score %d from %d, %d", res.Row1, res.Row2, res.Score, res.Start1, res.Start2)
+	}
+
+	// A gapped hit inside random flanks, the extension must not lose it
+	rnd := rand.New(rand.NewSource(4))
+	for i := 0; i < 50; i++ {
+		core := randomSeq(rnd, "ACGT", 60)
+		gapped := core[:30] + core[33:]
+		prefix1, prefix2 := randomSeq(rnd, "ACGT", rnd.Intn(100)), randomSeq(rnd, "ACGT", rnd.Intn(100))
+		seq1 := prefix1 + core + randomSeq(rnd, "ACGT", rnd.Intn(100))
+		seq2 := prefix2 + gapped + randomSeq(rnd, "ACGT", rnd.Intn(100))
+		res, err := engine.ExtendSeed(seq1, seq2, len(prefix1)+10, len(prefix2)+10, 30)
+		checkTest(err, t)
+		if res.Score < 57*5-12 || res.Start1 > len(prefix1) || res.End1 < len(prefix1)+len(core) {
+			t.Errorf("%s %s: hit lost, got %s %s score %d", seq1, seq2, res.Row1, res.Row2, res.Score)
+		}
+		if seq1[res.Start1:res.End1] != strings.Replace(res.Row1, "-", "", -1) ||
+			seq2[res.Start2:res.End2] != strings.Replace(res.Row2, "-", "", -1) {
+			t.Errorf("%s %s: bad coordinates %+v", seq1, seq2, res)
+		}
+	}
+
+	if _, err := engine.ExtendSeed("ACGT", "ACGT", 5, 0, 10); err != ErrBadSeed {
+		t.Errorf("Expected ErrBadSeed, got %v", err)
+	}
+}
+
+func TestAlignmentStats(t *testing.T) {
+	engine := NewAlignEngine(
+		func(a byte, b byte) (i int, e error) {
+			if a == b {
+				return +2, nil
+			} else if a == 'A' && b == 'G' || a == 'G' && b == 'A' {
+				return +1, nil
+			} else {
+				return -2, nil
+			}
+		},
+		-1,
+	)
+	res, err := engine.SmithWaterman("TTTTCTCTGAGTTT", "CCTCAGTCC")
+	checkTest(err, t)
+	expected := Alignment{
+		Row1: "CTCTGAGT", Row2: "CTC--AGT", Score: 10,
+		Start1: 4, End1: 12, Start2: 1, End2: 7,
+		Identities: 6, Similarities: 6, Gaps: 2, Cigar: "3=2D3=",
+	}
+	if res != expected {
+		t.Errorf("\nExpected: %+v\nGot:      %+v", expected, res)
+	}
+	res, err = engine.NeedlemanWunsch("GATTACA", "AATTCA")
+	checkTest(err, t)
+	expected = Alignment{
+		Row1: "GATTACA", Row2: "AATT-CA", Score: 10,
+		Start1: 0, End1: 7, Start2: 0, End2: 6,
+		Identities: 5, Similarities: 6, Gaps: 1, Cigar: "1X3=1D2=",
+	}
+	if res != expected {
+		t.Errorf("\nExpected: %+v\nGot:      %+v", expected, res)
+	}
+}
+
+func TestResidueErrors(t *testing.T) {
+	engine := NewAlignEngine(ScoreBLOSUM62, -4)
+	_, err := engine.NeedlemanWunsch("ARNDCQ", "ARN#CQ")
+	var residueErr *ResidueError
+	if !errors.As(err, &residueErr) {
+		t.Fatalf("Expected *ResidueError, got %v", err)
+	}
+	if residueErr.Residue != '#' || residueErr.Seq != 2 || residueErr.Pos != 3 {
+		t.Errorf("Wrong error location: %+v", residueErr)
+	}
+
+	_, index, err := engine.MultiAlignSequences("ARNDCQ", []string{"ARNDCQ", "AR1DCQ"})
+	var recordErr *RecordError
+	if !errors.As(err, &recordErr) || recordErr.Index != 1 {
+		t.Fatalf("Expected *RecordError for sequence 1, got %v (index %d)", err, index)
+	}
+	if !errors.As(err, &residueErr) || residueErr.Residue != '1' || residueErr.Pos != 2 {
+		t.Errorf("Wrong error location: %+v", residueErr)
+	}
+
+	// The search goes on past the bad sequences
+	hits, err := engine.FastaSearch("ARNDCQ", []Sequence{{Residues: "AR1DCQ"}, {}, {Residues: "ARNDCQ"}}, DefaultFastaParams())
+	checkTest(err, t)
+	if !errors.As(hits[0].Err, &recordErr) || recordErr.Index != 0 || !errors.Is(hits[1].Err, ErrEmptySequence) ||
+		hits[2].Err != nil || hits[2].Opt <= 0 || hits[2].ZScore != 50 {
+		t.Errorf("Hits with bad sequences: %+v", hits)
+	}
+
+	if _, _, err = engine.MultiAlignSequences("ARNDCQ", nil); err != ErrNoSequences {
+		t.Errorf("Expected ErrNoSequences, got %v", err)
+	}
+}
+
+func TestSubstitutionMatrix(t *testing.T) {
+	for _, pair := range []struct {
+		a, b  byte
+		score int
+	}{{'A', 'A', 4}, {'W', 'W', 11}, {'w', 'C', -2}, {'*', '*', 1}, {'Z', 'E', 4}} {
+		score, err := BLOSUM62.Score(pair.a, pair.b)
+		checkTest(err, t)
+		if score != pair.score {
+			t.Errorf("BLOSUM62 %c/%c: expected %d, got %d", pair.a, pair.b, pair.score, score)
+		}
+	}
+
+	_, err := DNAFull.Encode("ATGCNU")
+	var residueErr *ResidueError
+	if !errors.As(err, &residueErr) || residueErr.Residue != 'U' || residueErr.Pos != 5 {
+		t.Errorf("Expected error for \"U\" at position 5, got %v", err)
+	}
+
+	custom := MatrixFromFunc("custom", ScoreDNAFull)
+	for i := 0; i < len(DNAFull.Alphabet); i++ {
+		for j := 0; j < len(DNAFull.Alphabet); j++ {
+			a, b := DNAFull.Alphabet[i], DNAFull.Alphabet[j]
+			expected, _ := DNAFull.Score(a, b)
+			score, err := custom.Score(a, b)
+			checkTest(err, t)
+			if score != expected {
+				t.Errorf("MatrixFromFunc %c/%c: expected %d, got %d", a, b, expected, score)
+			}
+		}
+	}
+	if _, err := custom.Score('A', 'U'); err == nil {
+		t.Error("MatrixFromFunc accepts residue out of the alphabet")
+	}
+}
+
+func TestLoadMatrix(t *testing.T) {
+	const text = `# Transition/transversion matrix
+#
+   A  C  G  T
+T -2 -1 -2  2
+A  2 -2 -1 -2
+C -2  2 -2 -1
+G -1 -2  2 -2
+`
+	matrix, err := LoadMatrix(strings.NewReader(text))
+	checkTest(err, t)
+	if matrix == nil {
+		return
+	}
+	if matrix.Alphabet != "ACGT" {
+		t.Errorf("Expected alphabet ACGT, got %s", matrix.Alphabet)
+	}
+	for _, pair := range []struct {
+		a, b  byte
+		score int
+	}{{'A', 'A', 2}, {'A', 'G', -1}, {'T', 'A', -2}, {'c', 't', -1}} {
+		score, err := matrix.Score(pair.a, pair.b)
+		checkTest(err, t)
+		if score != pair.score {
+			t.Errorf("%c/%c: expected %d, got %d", pair.a, pair.b, pair.score, score)
+		}
+	}
+
+	for _, bad := range []string{
+		"   A  C\nA  1 -1\n",
+		"   A  C\nA  1 -1\nC -1\n",
+		"   A  C\nA  1 -1\nC -1  x\n",
+		"   A  C\nA  1 -1\nG -1  1\n",
+		"# only comments\n",
+	} {
+		if _, err := LoadMatrix(strings.NewReader(bad)); err == nil {
+			t.Errorf("Matrix accepted:\n%s", bad)
+		}
+	}
+}
+
+func TestMatrixRegistry(t *testing.T) {
+	for _, name := range MatrixNames() {
+		preset, ok := LookupMatrix(name)
+		if !ok || preset.Matrix.Name != name {
+			t.Errorf("Matrix %s is listed but not registered", name)
+			continue
+		}
+		if preset.GapOpen >= 0 || preset.GapExtend >= 0 {
+			t.Errorf("Matrix %s: gap penalties must be negative", name)
+		}
+		// Every built-in matrix is symmetric
+		alphabet := preset.Matrix.Alphabet
+		for i := 0; i < len(alphabet); i++ {
+			for j := 0; j < i; j++ {
+				s1, _ := preset.Matrix.Score(alphabet[i], alphabet[j])
+				s2, _ := preset.Matrix.Score(alphabet[j], alphabet[i])
+				if s1 != s2 {
+					t.Errorf("Matrix %s: %c/%c is not symmetric", name, alphabet[i], alphabet[j])
+				}
+			}
+		}
+	}
+	// The NCBI gap costs of every built-in matrix, "existence 15, extension 2" is -17/-2
+	for name, gap := range map[string][2]int{
+		"BLOSUM45": {-17, -2}, "BLOSUM50": {-15, -2}, "BLOSUM62": {-12, -1}, "BLOSUM80": {-11, -1},
+		"BLOSUM90": {-11, -1}, "PAM30": {-10, -1}, "PAM70": {-11, -1}, "PAM250": {-16, -2},
+	} {
+		preset, ok := LookupMatrix(name)
+		if !ok {
+			t.Errorf("Built-in matrix %s is not registered", name)
+		} else if preset.GapOpen != gap[0] || preset.GapExtend != gap[1] {
+			t.Errorf("%s: gap costs %d/%d, expected %d/%d", name, preset.GapOpen, preset.GapExtend, gap[0], gap[1])
+		}
+	}
+	// The other BLOSUM matrices come from the NCBI files in BLASTMAT only
+	if _, ok := LookupMatrix("BLOSUM30"); ok && os.Getenv("BLASTMAT") == "" {
+		t.Error("BLOSUM30 registered without BLASTMAT")
+	}
+	for _, test := range []struct {
+		name  string
+		a, b  byte
+		score int
+	}{
+		{"pam250", 'W', 'W', 17},
+		{"BLOSUM45", 'C', 'C', 12},
+		{"dnafull", 'A', 'T', -4},
+		{"NUC.4.4", 'G', 'G', 5},
+		{"TSTV.5.1.4", 'A', 'G', -1},
+		{"TSTV.5.1.4", 'U', 'G', -4},
+	} {
+		preset, ok := LookupMatrix(test.name)
+		if !ok {
+			t.Errorf("Matrix %s is not registered", test.name)
+			continue
+		}
+		score, err := preset.Matrix.Score(test.a, test.b)
+		checkTest(err, t)
+		if score != test.score {
+			t.Errorf("%s %c/%c: expected %d, got %d", test.name, test.a, test.b, test.score, score)
+		}
+	}
+	for name, nucleotide := range map[string]bool{"DNAFull": true, "TSTV.1.1.2": true, "BLOSUM62": false, "PAM30": false, "default": false} {
+		if preset, _ := LookupMatrix(name); preset.Matrix.IsNucleotide() != nucleotide {
+			t.Errorf("%s: nucleotide matrix %v", name, !nucleotide)
+		}
+	}
 }
 
 func format(test test, seq_res1, seq_res2 string) string {
@@ -193,6 +1437,15 @@ func TestPrettify(t *testing.T) {
 	}
 }
 
+func TestReverseComplement(t *testing.T) {
+	if res := utils.ReverseComplement("ACGTUacgtRYKMBVDHSWN-n"); res != "n-NWSDHBVKMRYacgtAACGT" {
+		t.Errorf("Reverse complement %s", res)
+	}
+	if res := utils.ReverseComplement(utils.ReverseComplement("GATTACArykmbvdh")); res != "GATTACArykmbvdh" {
+		t.Errorf("Double reverse complement %s", res)
+	}
+}
+
 func TestReverse(t *testing.T) {
 	str := "abcd"
 	if utils.ReverseStr(str) != "dcba" {
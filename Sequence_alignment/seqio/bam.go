@@ -0,0 +1,143 @@
+package seqio
+
+import (
+	"Bioinformatics/Sequence_alignment/algorithm"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"strings"
+)
+
+// Codes of the CIGAR operations in BAM
+const bamCigarOps = "MIDNSHP=X"
+
+// Residues of the 4-bit BAM sequence encoding, other residues are written as N
+const bamResidues = "=ACMGRSVTWYHKDBN"
+
+// Writes BAM: the binary SAM in BGZF blocks. Blocks are stored uncompressed,
+// the way samtools -u writes them for piping into other tools
+type BamWriter struct {
+	bgzf       *BGZFWriter
+	references map[string]int32
+}
+
+func NewBamWriter(writer io.Writer, references []SamReference) (*BamWriter, error) {
+	bam := &BamWriter{bgzf: NewBGZFWriter(writer, gzip.NoCompression), references: make(map[string]int32)}
+	text := samHeader(references)
+	var header []byte
+	header = append(header, "BAM\x01"...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(text)))
+	header = append(header, text...)
+	header = binary.LittleEndian.AppendUint32(header, uint32(len(references)))
+	for i, ref := range references {
+		bam.references[ref.Name] = int32(i)
+		header = binary.LittleEndian.AppendUint32(header, uint32(len(ref.Name)+1))
+		header = append(header, ref.Name...)
+		header = append(header, 0)
+		header = binary.LittleEndian.AppendUint32(header, uint32(ref.Length))
+	}
+	_, err := bam.bgzf.Write(header)
+	return bam, err
+}
+
+func (w *BamWriter) Write(record SamRecord) error {
+	refID, position := int32(-1), int32(record.Position)
+	if id, ok := w.references[record.Reference]; ok {
+		refID = id
+	}
+	parsed, err := algorithm.ParseCigar(record.Cigar)
+	if err != nil {
+		return err
+	}
+	var cigar []uint32
+	for _, op := range parsed {
+		cigar = append(cigar, uint32(op.Length)<<4|uint32(strings.IndexByte(bamCigarOps, op.Op)))
+	}
+	referenceLength, _ := parsed.Lengths()
+	end := record.Position + referenceLength
+	if referenceLength == 0 {
+		end = record.Position + 1
+	}
+	name := record.QueryName
+	if name == "" {
+		name = "*"
+	}
+
+	var data []byte
+	data = binary.LittleEndian.AppendUint32(data, uint32(refID))
+	data = binary.LittleEndian.AppendUint32(data, uint32(position))
+	data = append(data, byte(len(name)+1), byte(record.MapQ))
+	data = binary.LittleEndian.AppendUint16(data, uint16(regionBin(record.Position, end)))
+	data = binary.LittleEndian.AppendUint16(data, uint16(len(cigar)))
+	data = binary.LittleEndian.AppendUint16(data, uint16(record.Flag))
+	data = binary.LittleEndian.AppendUint32(data, uint32(len(record.Sequence)))
+	// No mate: next reference, next position and template length
+	data = binary.LittleEndian.AppendUint32(data, ^uint32(0))
+	data = binary.LittleEndian.AppendUint32(data, ^uint32(0))
+	data = binary.LittleEndian.AppendUint32(data, 0)
+	data = append(data, name...)
+	data = append(data, 0)
+	for _, op := range cigar {
+		data = binary.LittleEndian.AppendUint32(data, op)
+	}
+	for k := 0; k < len(record.Sequence); k += 2 {
+		packed := bamResidue(record.Sequence[k]) << 4
+		if k+1 < len(record.Sequence) {
+			packed |= bamResidue(record.Sequence[k+1])
+		}
+		data = append(data, packed)
+	}
+	for k := 0; k < len(record.Sequence); k++ {
+		if len(record.Quality) == len(record.Sequence) {
+			data = append(data, record.Quality[k]-33)
+		} else {
+			data = append(data, 0xff)
+		}
+	}
+	if record.Flag&SamUnmapped == 0 {
+		data = append(data, 'A', 'S', 'i')
+		data = binary.LittleEndian.AppendUint32(data, uint32(int32(record.Score)))
+		data = append(data, 'N', 'M', 'i')
+		data = binary.LittleEndian.AppendUint32(data, uint32(int32(record.Distance)))
+		data = append(data, 'M', 'D', 'Z')
+		data = append(data, record.MD...)
+		data = append(data, 0)
+	}
+
+	block := binary.LittleEndian.AppendUint32(nil, uint32(len(data)))
+	_, err = w.bgzf.Write(append(block, data...))
+	return err
+}
+
+// Writes the end of file block, the underlying writer stays open
+func (w *BamWriter) Close() error {
+	return w.bgzf.Close()
+}
+
+func bamResidue(residue byte) byte {
+	if residue >= 'a' && residue <= 'z' {
+		residue -= 'a' - 'A'
+	}
+	if code := strings.IndexByte(bamResidues, residue); code != -1 {
+		return byte(code)
+	}
+	return 15
+}
+
+// Bin of the UCSC binning scheme for the 0-based region [begin, end), reg2bin of the SAM specification
+func regionBin(begin int, end int) int {
+	end--
+	switch {
+	case begin>>14 == end>>14:
+		return ((1<<15)-1)/7 + (begin >> 14)
+	case begin>>17 == end>>17:
+		return ((1<<12)-1)/7 + (begin >> 17)
+	case begin>>20 == end>>20:
+		return ((1<<9)-1)/7 + (begin >> 20)
+	case begin>>23 == end>>23:
+		return ((1<<6)-1)/7 + (begin >> 23)
+	case begin>>26 == end>>26:
+		return ((1<<3)-1)/7 + (begin >> 26)
+	}
+	return 0
+}
@@ -0,0 +1,76 @@
+package seqio
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+)
+
+// Input bytes of one BGZF block, the same as htslib keeps below 64 KiB of output
+const bgzfBlockSize = 0xff00
+
+// Empty block that ends every BGZF file
+var bgzfEOF = []byte{
+	0x1f, 0x8b, 0x08, 0x04, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x06, 0x00, 0x42, 0x43,
+	0x02, 0x00, 0x1b, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+}
+
+// Writes BGZF blocks, the blocked gzip of BAM files. Close writes the end
+// of file block but does not close the underlying writer
+type BGZFWriter struct {
+	writer io.Writer
+	level  int
+	block  []byte
+	err    error
+}
+
+// Level is a compress/gzip level, gzip.NoCompression for uncompressed BAM
+func NewBGZFWriter(writer io.Writer, level int) *BGZFWriter {
+	return &BGZFWriter{writer: writer, level: level, block: make([]byte, 0, bgzfBlockSize)}
+}
+
+func (w *BGZFWriter) Write(data []byte) (int, error) {
+	written := 0
+	for w.err == nil && len(data) > 0 {
+		n := copy(w.block[len(w.block):cap(w.block)], data)
+		w.block, data, written = w.block[:len(w.block)+n], data[n:], written+n
+		if len(w.block) == cap(w.block) {
+			w.err = w.flushBlock()
+		}
+	}
+	return written, w.err
+}
+
+func (w *BGZFWriter) Close() error {
+	if w.err == nil && len(w.block) > 0 {
+		w.err = w.flushBlock()
+	}
+	if w.err == nil {
+		_, w.err = w.writer.Write(bgzfEOF)
+	}
+	return w.err
+}
+
+// Compresses the block into one gzip member with the "BC" subfield of its size
+func (w *BGZFWriter) flushBlock() error {
+	var member bytes.Buffer
+	zipper, err := gzip.NewWriterLevel(&member, w.level)
+	if err != nil {
+		return err
+	}
+	zipper.Extra = []byte{'B', 'C', 2, 0, 0, 0}
+	zipper.OS = 0xff
+	if _, err := zipper.Write(w.block); err != nil {
+		return err
+	}
+	if err := zipper.Close(); err != nil {
+		return err
+	}
+	// BSIZE follows the 10 bytes of the header, XLEN and the subfield id and length
+	raw := member.Bytes()
+	binary.LittleEndian.PutUint16(raw[16:], uint16(len(raw)-1))
+	w.block = w.block[:0]
+	_, err = w.writer.Write(raw)
+	return err
+}
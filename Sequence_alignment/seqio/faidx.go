@@ -0,0 +1,294 @@
+package seqio
+
+import (
+	"Bioinformatics/Sequence_alignment/algorithm"
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrLineLength      = errors.New("Lines of the record differ in length, the file can not be indexed")
+	ErrIndexFormat     = errors.New("Malformed .fai line")
+	ErrUnknownRecord   = errors.New("Record is not in the index")
+	ErrRegion          = errors.New("Malformed region, use name, name:start or name:start-end")
+	ErrCompressedIndex = errors.New("Indexed access to compressed files is not supported")
+)
+
+// Line of a .fai index, the same as samtools faidx writes
+type FaiEntry struct {
+	Name      string
+	Length    int   // Number of residues
+	Offset    int64 // Offset of the first residue in the file
+	LineBases int   // Residues in a full line
+	LineWidth int   // Bytes in a full line, with the line ending
+}
+
+// Index of a FASTA file: records by name in the order of the file
+type FaiIndex struct {
+	Entries []FaiEntry
+	names   map[string]int
+}
+
+func newFaiIndex(entries []FaiEntry) *FaiIndex {
+	index := &FaiIndex{Entries: entries, names: make(map[string]int, len(entries))}
+	for i, entry := range entries {
+		index.names[entry.Name] = i
+	}
+	return index
+}
+
+// The entry of the record by its identifier
+func (index *FaiIndex) Lookup(name string) (FaiEntry, bool) {
+	i, ok := index.names[name]
+	if !ok {
+		return FaiEntry{}, false
+	}
+	return index.Entries[i], true
+}
+
+// Indexes the uncompressed FASTA stream. Every line of a record but the last
+// must have the same length, the way samtools faidx requires
+func BuildFaiIndex(reader io.Reader) (*FaiIndex, error) {
+	buffered := bufio.NewReader(reader)
+	var entries []FaiEntry
+	var entry *FaiEntry
+	var offset int64
+	lineNumber := 0
+	lastLine := false // A line shorter than LineBases closes the record
+	for {
+		line, err := buffered.ReadString('\n')
+		if line == "" && err != nil {
+			if err != io.EOF {
+				return nil, &ParseError{Line: lineNumber + 1, Err: err}
+			}
+			break
+		}
+		lineNumber++
+		width := len(line)
+		bases := len(strings.TrimRight(line, "\r\n"))
+		offset += int64(width)
+		switch {
+		case strings.HasPrefix(line, ">"):
+			header := algorithm.NewSequence(strings.TrimRight(line[1:], "\r\n"), "")
+			entries = append(entries, FaiEntry{Name: header.ID, Offset: offset})
+			entry, lastLine = &entries[len(entries)-1], false
+		case entry == nil:
+			if bases > 0 {
+				return nil, &ParseError{Line: lineNumber, Err: ErrNoHeader}
+			}
+		case bases == 0 && entry.Length == 0:
+			entry.Offset = offset
+		case bases == 0:
+			lastLine = true
+		case lastLine:
+			return nil, &ParseError{Line: lineNumber, Err: ErrLineLength}
+		case entry.LineBases == 0:
+			entry.LineBases, entry.LineWidth = bases, width
+			entry.Length = bases
+		default:
+			// The last line of the file may have no line ending
+			ended := strings.HasSuffix(line, "\n")
+			if bases > entry.LineBases || (bases == entry.LineBases && width != entry.LineWidth && ended) {
+				return nil, &ParseError{Line: lineNumber, Err: ErrLineLength}
+			}
+			lastLine = bases < entry.LineBases || width != entry.LineWidth
+			entry.Length += bases
+		}
+	}
+	return newFaiIndex(entries), nil
+}
+
+// Reads the index in the .fai format
+func ReadFaiIndex(reader io.Reader) (*FaiIndex, error) {
+	scanner := bufio.NewScanner(reader)
+	var entries []FaiEntry
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(strings.TrimRight(scanner.Text(), "\r"), "\t")
+		// FASTQ indices have the sixth column of the quality offset
+		if len(fields) != 5 && len(fields) != 6 {
+			return nil, &ParseError{Line: line, Err: ErrIndexFormat}
+		}
+		var numbers [4]int64
+		for k := range numbers {
+			number, err := strconv.ParseInt(fields[k+1], 10, 64)
+			if err != nil || number < 0 {
+				return nil, &ParseError{Line: line, Err: ErrIndexFormat}
+			}
+			numbers[k] = number
+		}
+		entry := FaiEntry{Name: fields[0], Length: int(numbers[0]), Offset: numbers[1],
+			LineBases: int(numbers[2]), LineWidth: int(numbers[3])}
+		if entry.Length > 0 && (entry.LineBases == 0 || entry.LineWidth < entry.LineBases) {
+			return nil, &ParseError{Line: line, Err: ErrIndexFormat}
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return newFaiIndex(entries), nil
+}
+
+// Writes the index in the .fai format
+func (index *FaiIndex) Write(writer io.Writer) error {
+	buffered := bufio.NewWriter(writer)
+	for _, entry := range index.Entries {
+		if _, err := fmt.Fprintf(buffered, "%s\t%d\t%d\t%d\t%d\n",
+			entry.Name, entry.Length, entry.Offset, entry.LineBases, entry.LineWidth); err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// Part of a record: residues Start to End from 0, End excluded.
+// End 0 means the end of the record
+type Region struct {
+	Name       string
+	Start, End int
+}
+
+// Parses samtools region syntax name, name:start or name:start-end
+// with 1-based inclusive coordinates, thousands may be separated by commas
+func ParseRegion(region string) (Region, error) {
+	region = strings.TrimSpace(region)
+	colon := strings.LastIndexByte(region, ':')
+	if colon == -1 {
+		if region == "" {
+			return Region{}, ErrRegion
+		}
+		return Region{Name: region}, nil
+	}
+	result := Region{Name: region[:colon]}
+	bounds := strings.Replace(region[colon+1:], ",", "", -1)
+	from, to := bounds, ""
+	if dash := strings.IndexByte(bounds, '-'); dash != -1 {
+		from, to = bounds[:dash], bounds[dash+1:]
+	}
+	start, err := strconv.Atoi(from)
+	if err != nil || start < 1 || result.Name == "" {
+		return Region{}, ErrRegion
+	}
+	result.Start = start - 1
+	if to != "" {
+		if result.End, err = strconv.Atoi(to); err != nil || result.End < start {
+			return Region{}, ErrRegion
+		}
+	}
+	return result, nil
+}
+
+func (region Region) String() string {
+	if region.Start == 0 && region.End == 0 {
+		return region.Name
+	} else if region.End == 0 {
+		return fmt.Sprintf("%s:%d", region.Name, region.Start+1)
+	}
+	return fmt.Sprintf("%s:%d-%d", region.Name, region.Start+1, region.End)
+}
+
+// FASTA file with its index, reads regions without scanning the file
+type IndexedFasta struct {
+	Index *FaiIndex
+	file  io.ReaderAt
+}
+
+func NewIndexedFasta(file io.ReaderAt, index *FaiIndex) *IndexedFasta {
+	return &IndexedFasta{Index: index, file: file}
+}
+
+// Opens the FASTA file with its index path.fai. The index is built
+// when there is none and saved next to the file if the directory is writable
+func OpenIndexedFasta(path string) (*IndexedFasta, io.Closer, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	index, err := loadFaiIndex(path, file)
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return NewIndexedFasta(file, index), file, nil
+}
+
+func loadFaiIndex(path string, file *os.File) (*FaiIndex, error) {
+	if compression, err := DetectCompression(bufio.NewReader(file)); err != nil {
+		return nil, err
+	} else if compression != Uncompressed {
+		return nil, ErrCompressedIndex
+	}
+	if faiFile, err := os.Open(path + ".fai"); err == nil {
+		defer faiFile.Close()
+		return ReadFaiIndex(faiFile)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	index, err := BuildFaiIndex(file)
+	if err != nil {
+		return nil, err
+	}
+	// The index is only a cache, the region can be read without saving it
+	if faiFile, err := os.Create(path + ".fai"); err == nil {
+		if err := index.Write(faiFile); err != nil || faiFile.Close() != nil {
+			os.Remove(path + ".fai")
+		}
+	}
+	return index, nil
+}
+
+// Reads the region, parsed with ParseRegion. The record is named by the region
+// the way samtools faidx names it, the end is clipped to the record length
+func (fasta *IndexedFasta) Fetch(region string) (algorithm.Sequence, error) {
+	// Names with colons, e.g. HLA alleles, are looked up whole first
+	entry, ok := fasta.Index.Lookup(strings.TrimSpace(region))
+	parsed := Region{Name: entry.Name}
+	if !ok {
+		var err error
+		if parsed, err = ParseRegion(region); err != nil {
+			return algorithm.Sequence{}, err
+		}
+		if entry, ok = fasta.Index.Lookup(parsed.Name); !ok {
+			return algorithm.Sequence{}, fmt.Errorf("%w: %s", ErrUnknownRecord, parsed.Name)
+		}
+	}
+	residues, err := fasta.read(entry, parsed.Start, parsed.End)
+	if err != nil {
+		return algorithm.Sequence{}, err
+	}
+	return algorithm.Sequence{ID: parsed.String(), Residues: residues}, nil
+}
+
+// Residues start to end of the record, end 0 or beyond the record reads up to its end
+func (fasta *IndexedFasta) read(entry FaiEntry, start, end int) (string, error) {
+	if end == 0 || end > entry.Length {
+		end = entry.Length
+	}
+	if start >= end {
+		return "", nil
+	}
+	position := func(residue int) int64 {
+		return entry.Offset + int64(residue/entry.LineBases)*int64(entry.LineWidth) + int64(residue%entry.LineBases)
+	}
+	from, to := position(start), position(end-1)+1
+	raw := make([]byte, to-from)
+	if _, err := fasta.file.ReadAt(raw, from); err != nil {
+		return "", err
+	}
+	residues := make([]byte, 0, end-start)
+	for _, b := range raw {
+		if b != '\n' && b != '\r' {
+			residues = append(residues, b)
+		}
+	}
+	if len(residues) != end-start {
+		return "", fmt.Errorf("%w: %s does not match the file", ErrIndexFormat, entry.Name)
+	}
+	return string(residues), nil
+}
@@ -0,0 +1,177 @@
+package seqio
+
+import (
+	"Bioinformatics/Sequence_alignment/algorithm"
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Flag bits of a SAM record
+const (
+	SamUnmapped = 0x4
+	SamReverse  = 0x10
+)
+
+// MAPQ of the records, 255 means the mapping quality is not available
+const SamNoMapQ = 255
+
+// Reference sequence of the @SQ header line
+type SamReference struct {
+	Name   string
+	Length int
+}
+
+// One alignment line of a SAM file. Position is 0-based here
+// and written 1-based, -1 for an unmapped record
+type SamRecord struct {
+	QueryName string
+	Flag      int
+	Reference string
+	Position  int
+	MapQ      int
+	Cigar     string
+	Sequence  string
+	Quality   string
+	Score     int    // AS tag
+	Distance  int    // NM tag: mismatches and gap residues
+	MD        string // MD tag: matches and the reference residues of mismatches and deletions
+}
+
+// Record of the query aligned to the reference, Row1 of the alignment is the reference.
+// The query residues outside of the alignment are soft-clipped if query holds
+// the whole sequence, or hard-clipped up to queryLength if its residues are empty
+func NewSamRecord(reference string, query algorithm.Sequence, queryLength int, alignment algorithm.Alignment) (SamRecord, error) {
+	record := SamRecord{
+		QueryName: query.ID,
+		Reference: reference,
+		Position:  alignment.Start1,
+		MapQ:      SamNoMapQ,
+		Score:     alignment.Score,
+		Sequence:  query.Residues,
+		Quality:   query.Quality,
+	}
+	if record.QueryName == "" {
+		record.QueryName = "*"
+	}
+	if alignment.Length() == 0 {
+		record.Flag, record.Reference, record.Position, record.MapQ = SamUnmapped, "*", -1, 0
+		return record, nil
+	}
+	cigar, err := algorithm.ParseCigar(alignment.Cigar)
+	if err != nil {
+		return SamRecord{}, err
+	}
+	clip := byte('S')
+	if query.Residues == "" {
+		clip = 'H'
+		record.Sequence, record.Quality = alignedQuery(alignment, cigar), ""
+	}
+	clipped, err := alignment.ClippedCigar(queryLength, clip)
+	if err != nil {
+		return SamRecord{}, err
+	}
+	record.Cigar = clipped.String()
+	record.Distance, record.MD = mismatchTags(alignment, cigar)
+	return record, nil
+}
+
+// Residues of Row2 without the gaps of the deletions
+func alignedQuery(alignment algorithm.Alignment, cigar algorithm.Cigar) string {
+	var residues strings.Builder
+	column := 0
+	for _, op := range cigar {
+		if op.Op != 'D' {
+			residues.WriteString(alignment.Row2[column : column+op.Length])
+		}
+		column += op.Length
+	}
+	return residues.String()
+}
+
+// NM and MD tags of the alignment walked along its CIGAR
+func mismatchTags(alignment algorithm.Alignment, cigar algorithm.Cigar) (int, string) {
+	reference := strings.ToUpper(alignment.Row1)
+	var md strings.Builder
+	distance, matches, column := 0, 0, 0
+	for _, op := range cigar {
+		switch op.Op {
+		case '=':
+			matches += op.Length
+		case 'X', 'D':
+			distance += op.Length
+			md.WriteString(strconv.Itoa(matches))
+			if op.Op == 'D' {
+				md.WriteByte('^')
+				md.WriteString(reference[column : column+op.Length])
+			} else {
+				for k := column; k < column+op.Length; k++ {
+					if k > column {
+						md.WriteByte('0')
+					}
+					md.WriteByte(reference[k])
+				}
+			}
+			matches = 0
+		case 'I':
+			distance += op.Length
+		}
+		column += op.Length
+	}
+	md.WriteString(strconv.Itoa(matches))
+	return distance, md.String()
+}
+
+// Header lines of the SAM file with the references
+func samHeader(references []SamReference) string {
+	var header strings.Builder
+	header.WriteString("@HD\tVN:1.6\tSO:unsorted\n")
+	for _, ref := range references {
+		fmt.Fprintf(&header, "@SQ\tSN:%s\tLN:%d\n", ref.Name, ref.Length)
+	}
+	header.WriteString("@PG\tID:Sequence_alignment\tPN:Sequence_alignment\n")
+	return header.String()
+}
+
+// Writer of alignment records, SAM or BAM
+type RecordWriter interface {
+	Write(record SamRecord) error
+	Close() error
+}
+
+// Writes SAM text: the header, then a line of every record
+type SamWriter struct {
+	writer *bufio.Writer
+}
+
+func NewSamWriter(writer io.Writer, references []SamReference) (*SamWriter, error) {
+	sam := &SamWriter{writer: bufio.NewWriter(writer)}
+	_, err := sam.writer.WriteString(samHeader(references))
+	return sam, err
+}
+
+func (w *SamWriter) Write(record SamRecord) error {
+	orStar := func(field string) string {
+		if field == "" {
+			return "*"
+		}
+		return field
+	}
+	_, err := fmt.Fprintf(w.writer, "%s\t%d\t%s\t%d\t%d\t%s\t*\t0\t0\t%s\t%s",
+		record.QueryName, record.Flag, orStar(record.Reference), record.Position+1, record.MapQ,
+		orStar(record.Cigar), orStar(record.Sequence), orStar(record.Quality))
+	if err == nil && record.Flag&SamUnmapped == 0 {
+		_, err = fmt.Fprintf(w.writer, "\tAS:i:%d\tNM:i:%d\tMD:Z:%s", record.Score, record.Distance, record.MD)
+	}
+	if err == nil {
+		err = w.writer.WriteByte('\n')
+	}
+	return err
+}
+
+// Flushes the buffered records, the underlying writer stays open
+func (w *SamWriter) Close() error {
+	return w.writer.Flush()
+}
@@ -0,0 +1,306 @@
+// Streaming reader of sequence files
+package seqio
+
+import (
+	"Bioinformatics/Sequence_alignment/algorithm"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Layout of a sequence file
+type Format int
+
+const (
+	Unknown Format = iota // Not detected yet, the file has no records so far
+	FASTA
+	FASTQ
+	Plain // One sequence per line without headers
+)
+
+func (format Format) String() string {
+	switch format {
+	case FASTA:
+		return "FASTA"
+	case FASTQ:
+		return "FASTQ"
+	case Plain:
+		return "plain"
+	}
+	return "unknown"
+}
+
+// Compression of a sequence file, detected by its magic bytes
+type Compression int
+
+const (
+	Uncompressed Compression = iota
+	Gzip
+	BGZF // Blocked gzip of bgzip and samtools, every block is a gzip member
+)
+
+func (compression Compression) String() string {
+	switch compression {
+	case Gzip:
+		return "gzip"
+	case BGZF:
+		return "BGZF"
+	}
+	return "uncompressed"
+}
+
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// Detects the compression of the stream without consuming it.
+// BGZF sets the FEXTRA flag and the "BC" subfield in the first member header
+func DetectCompression(reader *bufio.Reader) (Compression, error) {
+	header, err := reader.Peek(16)
+	if err != nil && err != io.EOF {
+		return Uncompressed, err
+	}
+	if !bytes.HasPrefix(header, gzipMagic) {
+		return Uncompressed, nil
+	}
+	if len(header) == 16 && header[3]&0x04 != 0 && header[12] == 'B' && header[13] == 'C' {
+		return BGZF, nil
+	}
+	return Gzip, nil
+}
+
+// Decompresses the stream if it is gzip or BGZF, reads it as is otherwise
+func Decompress(reader io.Reader) (io.Reader, Compression, error) {
+	buffered := bufio.NewReader(reader)
+	compression, err := DetectCompression(buffered)
+	if err != nil || compression == Uncompressed {
+		return buffered, compression, err
+	}
+	// Members of BGZF and concatenated gzip files are read as one stream
+	unzipped, err := gzip.NewReader(buffered)
+	if err != nil {
+		return nil, compression, err
+	}
+	return unzipped, compression, nil
+}
+
+// Writes gzip if compress is set, or to the writer as is.
+// Close flushes the gzip stream but does not close the writer
+func NewWriter(writer io.Writer, compress bool) io.WriteCloser {
+	if compress {
+		return gzip.NewWriter(writer)
+	}
+	return nopCloser{writer}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+var (
+	ErrNoHeader        = errors.New("Sequence without a header")
+	ErrNoSeparator     = errors.New("FASTQ record without the '+' line")
+	ErrQualityLength   = errors.New("FASTQ quality and sequence lengths differ")
+	ErrTruncatedRecord = errors.New("File ends inside the record")
+)
+
+// Error of the file at the line, counted from 1
+type ParseError struct {
+	Line int
+	Err  error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("line %d: %v", e.Line, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// Iterates over the records of a FASTA, FASTQ or plain file, the format
+// is detected by the first non-blank line. Records may span many lines,
+// blank lines and CRLF endings are skipped. Gzip and BGZF files are decompressed
+//
+//	reader := seqio.NewReader(file)
+//	for reader.Next() {
+//		seq := reader.Sequence()
+//	}
+//	err := reader.Err()
+type Reader struct {
+	input       io.Reader
+	reader      *bufio.Reader // Nil until the compression is detected by the first Next
+	compression Compression
+	format      Format
+	line        int    // Number of the last read line
+	pending     string // Line read ahead, the header of the next record
+	ahead       bool
+	seq         algorithm.Sequence
+	err         error
+}
+
+func NewReader(reader io.Reader) *Reader {
+	return &Reader{input: reader}
+}
+
+// Reads the next record, false at the end of the file or on an error
+func (r *Reader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+	if r.reader == nil {
+		unzipped, compression, err := Decompress(r.input)
+		if err != nil {
+			r.err = err
+			return false
+		}
+		r.reader, r.compression = bufio.NewReader(unzipped), compression
+	}
+	line, ok := r.nextLine(true)
+	if !ok {
+		return false
+	}
+	if r.format == Unknown {
+		switch line[0] {
+		case '>':
+			r.format = FASTA
+		case '@':
+			r.format = FASTQ
+		default:
+			r.format = Plain
+		}
+	}
+	switch r.format {
+	case FASTA:
+		r.seq, r.err = r.readFasta(line)
+	case FASTQ:
+		r.seq, r.err = r.readFastq(line)
+	default:
+		r.seq = algorithm.Sequence{Residues: line}
+	}
+	return r.err == nil
+}
+
+// The record read by the last Next
+func (r *Reader) Sequence() algorithm.Sequence {
+	return r.seq
+}
+
+// The first error other than io.EOF, *ParseError for a malformed file
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Format of the file, Unknown until the first record is read
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Compression of the file, Uncompressed until the first record is read
+func (r *Reader) Compression() Compression {
+	return r.compression
+}
+
+// Reads every remaining record
+func (r *Reader) ReadAll() ([]algorithm.Sequence, error) {
+	var seqs []algorithm.Sequence
+	for r.Next() {
+		seqs = append(seqs, r.seq)
+	}
+	return seqs, r.err
+}
+
+func (r *Reader) readFasta(header string) (algorithm.Sequence, error) {
+	if header[0] != '>' {
+		return algorithm.Sequence{}, &ParseError{Line: r.line, Err: ErrNoHeader}
+	}
+	var residues strings.Builder
+	for {
+		line, ok := r.nextLine(true)
+		if !ok {
+			break
+		}
+		if line[0] == '>' {
+			r.unread(line)
+			break
+		}
+		residues.WriteString(line)
+	}
+	return algorithm.NewSequence(header[1:], residues.String()), r.err
+}
+
+// Sequence lines go up to the '+' line, quality lines until they are as long as the sequence,
+// so qualities starting with '@' are not taken for a header
+func (r *Reader) readFastq(header string) (algorithm.Sequence, error) {
+	if header[0] != '@' {
+		return algorithm.Sequence{}, &ParseError{Line: r.line, Err: ErrNoHeader}
+	}
+	var residues, quality strings.Builder
+	for {
+		line, ok := r.nextLine(true)
+		if !ok {
+			return algorithm.Sequence{}, r.truncated()
+		}
+		if line[0] == '+' {
+			break
+		}
+		if line[0] == '@' {
+			return algorithm.Sequence{}, &ParseError{Line: r.line, Err: ErrNoSeparator}
+		}
+		residues.WriteString(line)
+	}
+	for quality.Len() < residues.Len() {
+		line, ok := r.nextLine(false)
+		if !ok {
+			return algorithm.Sequence{}, r.truncated()
+		}
+		quality.WriteString(line)
+	}
+	if quality.Len() != residues.Len() {
+		return algorithm.Sequence{}, &ParseError{Line: r.line, Err: ErrQualityLength}
+	}
+	seq := algorithm.NewSequence(header[1:], residues.String())
+	seq.Quality = quality.String()
+	return seq, nil
+}
+
+func (r *Reader) truncated() error {
+	if r.err != nil {
+		return r.err
+	}
+	return &ParseError{Line: r.line, Err: ErrTruncatedRecord}
+}
+
+// Returns the next line without the line ending and surrounding spaces,
+// false at the end of the file or on an error. Blank lines are skipped
+// unless a quality line is expected, as it may be empty for an empty read
+func (r *Reader) nextLine(skipBlank bool) (string, bool) {
+	if r.ahead {
+		r.ahead = false
+		return r.pending, true
+	}
+	for {
+		line, err := r.reader.ReadString('\n')
+		if line == "" && err != nil {
+			if err != io.EOF {
+				r.err = &ParseError{Line: r.line + 1, Err: err}
+			}
+			return "", false
+		}
+		r.line++
+		line = strings.TrimSpace(line)
+		if line != "" || !skipBlank {
+			return line, true
+		}
+	}
+}
+
+func (r *Reader) unread(line string) {
+	r.pending, r.ahead = line, true
+}
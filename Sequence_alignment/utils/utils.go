@@ -75,3 +75,31 @@ func Prettify(sequence string, length int) string {
 	sb.WriteString(sequence)
 	return sb.String()
 }
+
+// IUPAC complements of the nucleotide codes, U is complemented to A.
+// Other characters, e.g. gaps, complement to themselves
+var complements = func() [256]byte {
+	var table [256]byte
+	for c := range table {
+		table[c] = byte(c)
+	}
+	pairs := "ATUAGCRYKMBVDHSSWWNN"
+	for k := 0; k < len(pairs); k += 2 {
+		a, b := pairs[k], pairs[k+1]
+		table[a], table[a+'a'-'A'] = b, b+'a'-'A'
+		if a != 'U' {
+			table[b], table[b+'a'-'A'] = a, a+'a'-'A'
+		}
+	}
+	return table
+}()
+
+// Reverse complement of the nucleotide sequence with IUPAC ambiguity codes,
+// the case of every residue is kept
+func ReverseComplement(sequence string) string {
+	res := make([]byte, len(sequence))
+	for i := 0; i < len(sequence); i++ {
+		res[len(sequence)-1-i] = complements[sequence[i]]
+	}
+	return string(res)
+}